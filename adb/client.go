@@ -0,0 +1,349 @@
+// Package adb implements a client for the adb server's host protocol, so that
+// devices can be controlled without running the adb executable.
+//
+// The protocol is described in
+// https://android.googlesource.com/platform/packages/modules/adb/+/refs/heads/main/OVERVIEW.TXT
+// and SERVICES.TXT next to it.
+package adb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the port the adb server listens on, unless overridden with
+// ANDROID_ADB_SERVER_PORT.
+const DefaultPort = 5037
+
+// ErrServerUnavailable is returned when the adb server can't be connected to,
+// for example, because it isn't running.
+var ErrServerUnavailable = errors.New("adb server unavailable")
+
+// ServerError is returned when the adb server responds with FAIL.
+type ServerError struct {
+	// Message is the reason of failure sent by the server, e.g. "device
+	// 'emulator-5554' not found".
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "adb server: " + e.Message
+}
+
+// ExitError is returned when a shell command exits with a non-zero status.
+type ExitError struct {
+	Code   int
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("exit status %d", e.Code)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+
+	return msg
+}
+
+// Device is a device attached to the adb server.
+type Device struct {
+	Serial string
+
+	// State of the device, e.g. "device", "offline", or "unauthorized".
+	State string
+}
+
+// Client talks to the adb server. It's safe for concurrent use by multiple
+// goroutines, because every request uses a new connection.
+type Client struct {
+	// Addr is the address of the adb server, e.g. "127.0.0.1:5037".
+	Addr string
+}
+
+// NewClient returns a client of the adb server running on this machine.
+func NewClient() *Client {
+	port := strconv.Itoa(DefaultPort)
+	if p := os.Getenv("ANDROID_ADB_SERVER_PORT"); p != "" {
+		port = p
+	}
+
+	return &Client{Addr: net.JoinHostPort("127.0.0.1", port)}
+}
+
+// Devices returns devices attached to the adb server.
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = request(conn, "host:devices")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readHexPrefixed(conn)
+	if err != nil {
+		return nil, fmt.Errorf("read devices: %w", err)
+	}
+
+	// Sample response:
+	// emulator-5554	device
+	// emulator-5556	offline
+	var devices []Device
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		devices = append(devices, Device{Serial: fields[0], State: fields[1]})
+	}
+
+	return devices, nil
+}
+
+// Features returns features supported by both the adb server and the device
+// with serial, or the only device if serial is empty, e.g. "shell_v2".
+func (c *Client) Features(ctx context.Context, serial string) ([]string, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := "host:features"
+	if serial != "" {
+		req = "host-serial:" + serial + ":features"
+	}
+
+	err = request(conn, req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readHexPrefixed(conn)
+	if err != nil {
+		return nil, fmt.Errorf("read features: %w", ctxErr(ctx, err))
+	}
+
+	return strings.Split(string(data), ","), nil
+}
+
+// Shell runs cmd in the shell of the device with serial and returns its
+// standard output. Arguments are joined with spaces, as with "adb shell".
+//
+// On devices supporting the shell v2 protocol, Android 7.0 and newer, the
+// exit status is known: if the command exits with a non-zero status, the error
+// is *ExitError. On older devices, standard output and standard error are
+// returned together, and the exit status is ignored.
+func (c *Client) Shell(ctx context.Context, serial string, cmd ...string) ([]byte, error) {
+	features, err := c.Features(ctx, serial)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(features, "shell_v2") {
+		return c.shellV1(ctx, serial, cmd...)
+	}
+
+	conn, err := c.transport(ctx, serial, "shell,v2,raw:"+strings.Join(cmd, " "))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var stdout, stderr []byte
+	for {
+		// Each packet is: id (1 byte), length (4 bytes, little endian), data.
+		var header [5]byte
+		_, err := io.ReadFull(conn, header[:])
+		if err != nil {
+			return stdout, fmt.Errorf("read shell packet: %w", ctxErr(ctx, err))
+		}
+
+		data := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			return stdout, fmt.Errorf("read shell packet: %w", ctxErr(ctx, err))
+		}
+
+		switch header[0] {
+		case shellStdout:
+			stdout = append(stdout, data...)
+		case shellStderr:
+			stderr = append(stderr, data...)
+		case shellExit:
+			if len(data) != 1 {
+				return stdout, fmt.Errorf("invalid exit packet of length %d", len(data))
+			}
+			if data[0] != 0 {
+				return stdout, &ExitError{Code: int(data[0]), Stderr: string(stderr)}
+			}
+			return stdout, nil
+		}
+	}
+}
+
+// shellV1 runs cmd with the shell protocol of devices older than Android 7.0,
+// which has no way to report the exit status.
+func (c *Client) shellV1(ctx context.Context, serial string, cmd ...string) ([]byte, error) {
+	conn, err := c.transport(ctx, serial, "shell:"+strings.Join(cmd, " "))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		return out, fmt.Errorf("read output: %w", ctxErr(ctx, err))
+	}
+
+	return out, nil
+}
+
+// Exec runs cmd on the device with serial without a shell and returns its
+// raw standard output. Unlike Shell, the exit status isn't available.
+func (c *Client) Exec(ctx context.Context, serial string, cmd ...string) ([]byte, error) {
+	conn, err := c.transport(ctx, serial, "exec:"+strings.Join(cmd, " "))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		return out, fmt.Errorf("read output: %w", ctxErr(ctx, err))
+	}
+
+	return out, nil
+}
+
+// Shell v2 packet IDs.
+const (
+	shellStdout = 1
+	shellStderr = 2
+	shellExit   = 3
+)
+
+// transport connects to the device with serial, or to the only device if
+// serial is empty, and opens service on it.
+func (c *Client) transport(ctx context.Context, serial, service string) (net.Conn, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := "host:transport-any"
+	if serial != "" {
+		transport = "host:transport:" + serial
+	}
+
+	err = request(conn, transport)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	err = request(conn, service)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// dial connects to the adb server. The connection is closed when ctx is done.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %v", ErrServerUnavailable, err)
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return &ctxConn{Conn: conn, stop: stop}, nil
+}
+
+// ctxConn is a connection that is closed when its context is done.
+type ctxConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// request sends a request to the adb server and reads its status.
+func request(conn net.Conn, req string) error {
+	_, err := fmt.Fprintf(conn, "%04x%s", len(req), req)
+	if err != nil {
+		return fmt.Errorf("send %s: %w", req, err)
+	}
+
+	return readStatus(conn)
+}
+
+// readStatus reads OKAY or FAIL followed by a message.
+func readStatus(r io.Reader) error {
+	var status [4]byte
+	_, err := io.ReadFull(r, status[:])
+	if err != nil {
+		return fmt.Errorf("read status: %w", err)
+	}
+
+	switch string(status[:]) {
+	case "OKAY":
+		return nil
+	case "FAIL":
+		msg, err := readHexPrefixed(r)
+		if err != nil {
+			return fmt.Errorf("read failure message: %w", err)
+		}
+		return &ServerError{Message: string(msg)}
+	default:
+		return fmt.Errorf("unexpected status %q", status)
+	}
+}
+
+// readHexPrefixed reads data prefixed with its length as 4 hex digits.
+func readHexPrefixed(r io.Reader) ([]byte, error) {
+	var hexLen [4]byte
+	_, err := io.ReadFull(r, hexLen[:])
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.ParseUint(string(hexLen[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid length %q", hexLen)
+	}
+
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+// ctxErr returns the error of ctx if it's done, since then err is only a
+// consequence of closing the connection.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
@@ -0,0 +1,295 @@
+package adb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeServer is an adb server that handles each connection with the next of
+// its handlers.
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+	handlers chan func(conn net.Conn)
+}
+
+func newFakeServer(t *testing.T, handlers ...func(conn net.Conn)) *fakeServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &fakeServer{t: t, listener: listener, handlers: make(chan func(net.Conn), len(handlers))}
+	for _, handler := range handlers {
+		s.handlers <- handler
+	}
+	close(s.handlers)
+
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) client() *Client {
+	return &Client{Addr: s.listener.Addr().String()}
+}
+
+func (s *fakeServer) serve() {
+	for handler := range s.handlers {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		handler(conn)
+		conn.Close()
+	}
+}
+
+// readRequest reads a request sent to the adb server.
+func readRequest(t *testing.T, conn net.Conn) string {
+	t.Helper()
+
+	var hexLen [4]byte
+	_, err := io.ReadFull(conn, hexLen[:])
+	if err != nil {
+		t.Errorf("read request length: %v", err)
+		return ""
+	}
+	n, _ := strconv.ParseUint(string(hexLen[:]), 16, 16)
+	req := make([]byte, n)
+	_, err = io.ReadFull(conn, req)
+	if err != nil {
+		t.Errorf("read request: %v", err)
+		return ""
+	}
+
+	return string(req)
+}
+
+// expect reads a request from conn and responds with OKAY if it's want, or
+// with FAIL otherwise.
+func expect(t *testing.T, conn net.Conn, want string) bool {
+	t.Helper()
+
+	req := readRequest(t, conn)
+	if req != want {
+		t.Errorf("request = %q, want %q", req, want)
+		fail(conn, "unexpected request")
+		return false
+	}
+
+	conn.Write([]byte("OKAY"))
+	return true
+}
+
+func fail(conn net.Conn, msg string) {
+	fmt.Fprintf(conn, "FAIL%04x%s", len(msg), msg)
+}
+
+// features returns a handler responding to a request for features of the
+// device with serial.
+func features(t *testing.T, serial, list string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		if expect(t, conn, "host-serial:"+serial+":features") {
+			fmt.Fprintf(conn, "%04x%s", len(list), list)
+		}
+	}
+}
+
+func shellPacket(id byte, data string) []byte {
+	packet := []byte{id, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(packet[1:], uint32(len(data)))
+	return append(packet, data...)
+}
+
+func syncPacket(id string, data []byte) []byte {
+	packet := append([]byte(id), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(packet[4:], uint32(len(data)))
+	return append(packet, data...)
+}
+
+func TestDevices(t *testing.T) {
+	server := newFakeServer(t, func(conn net.Conn) {
+		if expect(t, conn, "host:devices") {
+			data := "emulator-5554\tdevice\nemulator-5556\toffline\n"
+			fmt.Fprintf(conn, "%04x%s", len(data), data)
+		}
+	})
+
+	devices, err := server.client().Devices(context.Background())
+	if err != nil {
+		t.Fatalf("Devices() error: %v", err)
+	}
+
+	want := []Device{{Serial: "emulator-5554", State: "device"}, {Serial: "emulator-5556", State: "offline"}}
+	if len(devices) != len(want) || devices[0] != want[0] || devices[1] != want[1] {
+		t.Errorf("Devices() = %v, want %v", devices, want)
+	}
+}
+
+func TestShell(t *testing.T) {
+	server := newFakeServer(t,
+		features(t, "emulator-5554", "shell_v2,cmd,stat_v2"),
+		func(conn net.Conn) {
+			if expect(t, conn, "host:transport:emulator-5554") && expect(t, conn, "shell,v2,raw:wm density") {
+				conn.Write(shellPacket(shellStdout, "Physical "))
+				conn.Write(shellPacket(shellStdout, "density: 420\n"))
+				conn.Write(shellPacket(shellExit, "\x00"))
+			}
+		},
+		features(t, "emulator-5554", "shell_v2,cmd,stat_v2"),
+		func(conn net.Conn) {
+			if expect(t, conn, "host:transport:emulator-5554") && expect(t, conn, "shell,v2,raw:false") {
+				conn.Write(shellPacket(shellStderr, "oops\n"))
+				conn.Write(shellPacket(shellExit, "\x01"))
+			}
+		},
+		func(conn net.Conn) {
+			readRequest(t, conn)
+			fail(conn, "device 'emulator-5556' not found")
+		},
+	)
+	client := server.client()
+
+	out, err := client.Shell(context.Background(), "emulator-5554", "wm", "density")
+	if err != nil {
+		t.Fatalf("Shell() error: %v", err)
+	}
+	if string(out) != "Physical density: 420\n" {
+		t.Errorf("Shell() = %q, want %q", out, "Physical density: 420\n")
+	}
+
+	_, err = client.Shell(context.Background(), "emulator-5554", "false")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 1 || exitErr.Stderr != "oops\n" {
+		t.Errorf("Shell() error = %v, want exit status 1", err)
+	}
+
+	_, err = client.Shell(context.Background(), "emulator-5556", "true")
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) {
+		t.Errorf("Shell() on unknown device: error = %v, want *ServerError", err)
+	}
+}
+
+func TestShellWithoutShellV2(t *testing.T) {
+	server := newFakeServer(t,
+		features(t, "emulator-5554", "cmd"),
+		func(conn net.Conn) {
+			if !expect(t, conn, "host:transport:emulator-5554") {
+				return
+			}
+
+			// Devices without shell v2 fail to open it.
+			req := readRequest(t, conn)
+			if req != "shell:wm density" {
+				t.Errorf("request = %q, want %q", req, "shell:wm density")
+				fail(conn, "closed")
+				return
+			}
+			conn.Write([]byte("OKAY"))
+			conn.Write([]byte("Physical density: 420\r\n"))
+		},
+	)
+
+	out, err := server.client().Shell(context.Background(), "emulator-5554", "wm", "density")
+	if err != nil {
+		t.Fatalf("Shell() error: %v", err)
+	}
+	if string(out) != "Physical density: 420\r\n" {
+		t.Errorf("Shell() = %q, want %q", out, "Physical density: 420\r\n")
+	}
+}
+
+func TestServerUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, err = (&Client{Addr: addr}).Devices(context.Background())
+	if !errors.Is(err, ErrServerUnavailable) {
+		t.Errorf("Devices() error = %v, want %v", err, ErrServerUnavailable)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	content := bytes.Repeat([]byte("emu"), maxSyncChunk)
+	mtime := time.Unix(1700000000, 0)
+
+	server := newFakeServer(t,
+		func(conn net.Conn) {
+			if !expect(t, conn, "host:transport:emulator-5554") || !expect(t, conn, "sync:") {
+				return
+			}
+
+			var received []byte
+			for {
+				id, data, err := readSyncResponse(conn)
+				if err != nil {
+					t.Errorf("read sync request: %v", err)
+					return
+				}
+
+				switch id {
+				case "SEND":
+					if string(data) != "/sdcard/emu.txt,420" {
+						t.Errorf("SEND %q, want %q", data, "/sdcard/emu.txt,420")
+					}
+				case "DATA":
+					received = append(received, data...)
+				case "DONE":
+					if !bytes.Equal(received, content) {
+						t.Errorf("pushed %d bytes, want %d", len(received), len(content))
+					}
+					conn.Write(syncPacket("OKAY", nil))
+				case "QUIT":
+					return
+				}
+			}
+		},
+		func(conn net.Conn) {
+			if !expect(t, conn, "host:transport:emulator-5554") || !expect(t, conn, "sync:") {
+				return
+			}
+
+			id, data, _ := readSyncResponse(conn)
+			if id != "RECV" || string(data) != "/sdcard/emu.txt" {
+				t.Errorf("request = %s %q, want RECV %q", id, data, "/sdcard/emu.txt")
+			}
+
+			conn.Write(syncPacket("DATA", content[:maxSyncChunk]))
+			conn.Write(syncPacket("DATA", content[maxSyncChunk:]))
+			conn.Write(syncPacket("DONE", nil))
+			io.Copy(io.Discard, conn)
+		},
+	)
+	client := server.client()
+
+	err := client.Push(context.Background(), "emulator-5554", bytes.NewReader(content), "/sdcard/emu.txt", 0o644, mtime)
+	if err != nil {
+		t.Fatalf("Push() error: %v", err)
+	}
+
+	var pulled bytes.Buffer
+	err = client.Pull(context.Background(), "emulator-5554", "/sdcard/emu.txt", &pulled)
+	if err != nil {
+		t.Fatalf("Pull() error: %v", err)
+	}
+	if !bytes.Equal(pulled.Bytes(), content) {
+		t.Errorf("pulled %d bytes, want %d", pulled.Len(), len(content))
+	}
+}
@@ -0,0 +1,147 @@
+package adb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"time"
+)
+
+// maxSyncChunk is the maximum size of data sent in a single DATA request.
+const maxSyncChunk = 64 * 1024
+
+// Push writes the contents of r to the file at path on the device with serial.
+func (c *Client) Push(ctx context.Context, serial string, r io.Reader, path string, mode fs.FileMode, mtime time.Time) error {
+	conn, err := c.transport(ctx, serial, "sync:")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = syncRequest(conn, "SEND", []byte(fmt.Sprintf("%s,%d", path, mode.Perm())))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxSyncChunk)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			err := syncRequest(conn, "DATA", buf[:n])
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+	}
+
+	err = syncHeader(conn, "DONE", uint32(mtime.Unix()))
+	if err != nil {
+		return err
+	}
+
+	id, data, err := readSyncResponse(conn)
+	if err != nil {
+		return fmt.Errorf("push %s: %w", path, ctxErr(ctx, err))
+	}
+	if id == "FAIL" {
+		return &ServerError{Message: string(data)}
+	}
+	if id != "OKAY" {
+		return fmt.Errorf("push %s: unexpected response %q", path, id)
+	}
+
+	return syncHeader(conn, "QUIT", 0)
+}
+
+// Pull writes the contents of the file at path on the device with serial to
+// w.
+func (c *Client) Pull(ctx context.Context, serial string, path string, w io.Writer) error {
+	conn, err := c.transport(ctx, serial, "sync:")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = syncRequest(conn, "RECV", []byte(path))
+	if err != nil {
+		return err
+	}
+
+	for {
+		id, data, err := readSyncResponse(conn)
+		if err != nil {
+			return fmt.Errorf("pull %s: %w", path, ctxErr(ctx, err))
+		}
+
+		switch id {
+		case "DATA":
+			_, err := w.Write(data)
+			if err != nil {
+				return fmt.Errorf("write %s: %w", path, err)
+			}
+		case "DONE":
+			return syncHeader(conn, "QUIT", 0)
+		case "FAIL":
+			return &ServerError{Message: string(data)}
+		default:
+			return fmt.Errorf("pull %s: unexpected response %q", path, id)
+		}
+	}
+}
+
+// syncHeader sends a sync request id with a 32-bit little endian argument.
+func syncHeader(conn net.Conn, id string, arg uint32) error {
+	var header [8]byte
+	copy(header[:4], id)
+	binary.LittleEndian.PutUint32(header[4:], arg)
+
+	_, err := conn.Write(header[:])
+	if err != nil {
+		return fmt.Errorf("send %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// syncRequest sends a sync request id followed by data.
+func syncRequest(conn net.Conn, id string, data []byte) error {
+	err := syncHeader(conn, id, uint32(len(data)))
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("send %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// readSyncResponse reads a sync response. For DONE, which has no data, the
+// returned data is nil.
+func readSyncResponse(r io.Reader) (string, []byte, error) {
+	var header [8]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	id := string(header[:4])
+	if id == "DONE" {
+		return id, nil, nil
+	}
+
+	data := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+	_, err = io.ReadFull(r, data)
+	return id, data, err
+}
@@ -1,19 +1,124 @@
 package emulator
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"fmt"
+	"io/fs"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/bartekpacia/emu/ini"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 )
 
+// CreateOptions configures a new AVD. Settings that are empty or 0 keep the
+// defaults of avdmanager, except for RAMSize and HeapSize.
+type CreateOptions struct {
+	// Name of the AVD. If empty, it's derived from Device and the API level
+	// of the system image, e.g. "Pixel_7_API_34". If an AVD with that name
+	// already exists, the tag and ABI of the system image are appended, e.g.
+	// "Pixel_7_API_34_google_apis_playstore".
+	Name string
+
+	// Device is the hardware profile of the AVD, e.g. "pixel_7". Run
+	// 'avdmanager list device' to see available profiles.
+	Device string
+
+	// Skin is the name of the frame around the screen, from the skins
+	// directory of the SDK, e.g. "pixel_7". No frame is shown if empty.
+	Skin string
+
+	// Tag and ABI of the system image, e.g. "google_apis" and "arm64-v8a".
+	// They're needed only if the package contains several images.
+	Tag string
+	ABI string
+
+	// SDCardMB is the size of the SD card in megabytes. No SD card is created
+	// if 0.
+	SDCardMB int
+
+	// RAMSize is the size of RAM, e.g. "4G". 4G if empty.
+	RAMSize string
+
+	// HeapSize is the maximum heap size of an app, e.g. "512M". 1024M if
+	// empty.
+	HeapSize string
+
+	// Cores is the number of CPU cores.
+	Cores int
+
+	// DataPartitionSize is the size of the data partition, e.g. "8G".
+	DataPartitionSize string
+
+	// GPU is the GPU emulation mode, e.g. "host" or "swiftshader_indirect".
+	GPU string
+
+	// NoKeyboard disables input from the host keyboard, which is enabled by
+	// default.
+	NoKeyboard bool
+
+	// Config sets other keys of config.ini. It overrides all other options.
+	Config map[string]string
+}
+
+// config returns config.ini settings of the new AVD, in the order they're
+// applied.
+func (o CreateOptions) config(sdkRoot string) ([][2]string, error) {
+	ramSize, heapSize, keyboard := o.RAMSize, o.HeapSize, "yes"
+	if ramSize == "" {
+		ramSize = "4G"
+	}
+	if heapSize == "" {
+		// Values inspired by: https://garden.pacia.tech/managing-avd-from-terminal
+		heapSize = "1024M"
+	}
+	if o.NoKeyboard {
+		keyboard = "no"
+	}
+
+	settings := [][2]string{
+		{"hw.keyboard", keyboard},
+		{"vm.heapSize", heapSize},
+		{"hw.ramSize", ramSize},
+	}
+	if o.Cores != 0 {
+		settings = append(settings, [2]string{"hw.cpu.ncore", strconv.Itoa(o.Cores)})
+	}
+	if o.DataPartitionSize != "" {
+		settings = append(settings, [2]string{"disk.dataPartition.size", o.DataPartitionSize})
+	}
+	if o.GPU != "" {
+		settings = append(settings, [2]string{"hw.gpu.enabled", "yes"}, [2]string{"hw.gpu.mode", o.GPU})
+	}
+	if o.Skin != "" {
+		settings = append(settings,
+			[2]string{"skin.name", o.Skin},
+			[2]string{"skin.path", filepath.Join(sdkRoot, "skins", o.Skin)},
+			[2]string{"showDeviceFrame", "yes"},
+		)
+	}
+
+	keys := slices.Sorted(maps.Keys(o.Config))
+	for _, key := range keys {
+		settings = append(settings, [2]string{key, o.Config[key]})
+	}
+
+	for _, setting := range settings {
+		err := ValidateConfig(setting[0], setting[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return settings, nil
+}
+
 // CreateAVD creates a new Android Virtual Device and returns its name and path.
 //
 // It wraps the avdmanager tool from Android SDK.Example AVD manager invocation:
@@ -26,61 +131,214 @@ import (
 //
 // In addition, it also automatically enables keyboard input.
 func CreateAVD(osimage SystemImage, skin string, sdcardMB int) (string, string, error) {
-	avdName := cases.Title(language.English, cases.NoLower).String(skin)
-	avdName = fmt.Sprint(avdName, "_API_", osimage.ApiLevel())
+	return CreateAVDContext(context.Background(), osimage, skin, sdcardMB)
+}
+
+// CreateAVDContext is like CreateAVD but uses ctx to run avdmanager.
+func CreateAVDContext(ctx context.Context, osimage SystemImage, skin string, sdcardMB int) (string, string, error) {
+	return CreateAVDWithOptions(ctx, osimage, CreateOptions{Device: skin, SDCardMB: sdcardMB})
+}
+
+// CreateAVDWithOptions is like CreateAVDContext but creates the AVD with
+// opts.
+func CreateAVDWithOptions(ctx context.Context, osimage SystemImage, opts CreateOptions) (string, string, error) {
+	sdk := LocateSDK()
+	avdHome, err := sdk.avdHome()
+	if err != nil {
+		return "", "", err
+	}
+
+	settings, err := opts.config(sdk.Root)
+	if err != nil {
+		return "", "", err
+	}
+
+	avdName := opts.Name
+	if avdName == "" {
+		avdName = defaultAVDName(avdHome, osimage, opts.Device)
+	} else if !avdNameRegexp.MatchString(avdName) {
+		return "", "", fmt.Errorf("invalid AVD name %q, allowed characters are a-z, A-Z, 0-9, '.', '_', and '-'", avdName)
+	} else if avdExists(avdHome, avdName) {
+		return "", "", fmt.Errorf("%w: %s", ErrExists, avdName)
+	}
+
 	args := []string{"create", "avd"}
-	args = append(args, "--sdcard", strconv.Itoa(sdcardMB)+"M")
+	if opts.SDCardMB != 0 {
+		args = append(args, "--sdcard", strconv.Itoa(opts.SDCardMB)+"M")
+	}
 	args = append(args, "--package", string(osimage))
 	args = append(args, "--name", avdName)
-	args = append(args, "--device", skin)
+	if opts.Device != "" {
+		args = append(args, "--device", opts.Device)
+	}
+	if opts.Tag != "" {
+		args = append(args, "--tag", opts.Tag)
+	}
+	if opts.ABI != "" {
+		args = append(args, "--abi", opts.ABI)
+	}
 
-	var stderr bytes.Buffer
-	cmd := exec.Command("avdmanager", args...)
-	printInvocation(cmd)
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	_, err = CommandRunner.Run(ctx, sdk.AVDManager(), args...)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to run %s: %v, %v", cmd, err, stderr.String())
+		return "", "", fmt.Errorf("failed to run avdmanager %s: %w", strings.Join(args, " "), err)
 	}
 
-	avdPath := filepath.Join(os.Getenv("ANDROID_USER_HOME"), "avd", avdName+".avd")
-	err = updateConfig(avdPath)
+	avdPath := filepath.Join(avdHome, avdName+".avd")
+	err = updateConfig(avdPath, settings)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to update config %s: %v", avdPath, err)
+		return "", "", fmt.Errorf("failed to update config %s: %w", avdPath, err)
 	}
 
 	return avdName, avdPath, nil
 }
 
+// DeleteAVD deletes the AVD with avdName and all its data. It fails with
+// ErrAlreadyRunning if the AVD is running.
 func DeleteAVD(avdName string) error {
-	avdIniPath := filepath.Join(os.Getenv("ANDROID_USER_HOME"), "avd", avdName+".ini")
-	err := os.Remove(avdIniPath)
+	return DeleteAVDContext(context.Background(), avdName)
+}
+
+// DeleteAVDContext is like DeleteAVD but uses ctx to run external programs.
+func DeleteAVDContext(ctx context.Context, avdName string) error {
+	_, err := DeleteAVDSize(ctx, avdName)
+	return err
+}
+
+// DeleteAVDSize is like DeleteAVDContext but also returns the number of bytes
+// freed.
+//
+// The AVD's directory is first moved aside, then its ini file is deleted, so
+// that a failure doesn't leave an AVD without data or data without an AVD.
+func DeleteAVDSize(ctx context.Context, avdName string) (int64, error) {
+	avdHome, err := AVDHome()
 	if err != nil {
-		return fmt.Errorf("delete AVD ini file: %v", err)
+		return 0, err
 	}
 
-	avdDirPath := filepath.Join(os.Getenv("ANDROID_USER_HOME"), "avd", avdName+".avd")
-	err = os.RemoveAll(avdDirPath)
+	avds, err := ListContext(ctx)
 	if err != nil {
-		return fmt.Errorf("delete AVD directory: %v", err)
+		return 0, fmt.Errorf("list avds: %w", err)
+	}
+
+	i := slices.IndexFunc(avds, func(avd AVD) bool { return avd.Name == avdName })
+	if i == -1 {
+		return 0, fmt.Errorf("%w: %s", ErrNotFound, avdName)
+	}
+	avd := avds[i]
+	if avd.Running {
+		return 0, fmt.Errorf("%w: %s", ErrAlreadyRunning, avdName)
+	}
+
+	avdIniPath := filepath.Join(avdHome, avdName+".ini")
+	avdDirPath := avd.Path
+	if avdDirPath == "" {
+		avdDirPath = filepath.Join(avdHome, avdName+".avd")
 	}
 
-	return nil
+	size := fileSize(avdIniPath) + dirSize(avdDirPath)
+
+	trashPath := ""
+	if isDir(avdDirPath) {
+		trashPath = fmt.Sprintf("%s.deleting-%d", avdDirPath, os.Getpid())
+		err = os.Rename(avdDirPath, trashPath)
+		if err != nil {
+			return 0, fmt.Errorf("move AVD directory: %w", err)
+		}
+	}
+
+	err = os.Remove(avdIniPath)
+	if err != nil {
+		if trashPath != "" {
+			_ = os.Rename(trashPath, avdDirPath)
+		}
+		return 0, fmt.Errorf("delete AVD ini file: %w", err)
+	}
+
+	if trashPath != "" {
+		err = os.RemoveAll(trashPath)
+		if err != nil {
+			return 0, fmt.Errorf("delete AVD directory, remove %s manually: %w", trashPath, err)
+		}
+	}
+
+	return size, nil
+}
+
+// fileSize returns the size of the file at path, or 0 if it can't be read.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// dirSize returns the total size of files in the directory at path. Files
+// that can't be read are skipped.
+func dirSize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+
+	return size
+}
+
+// DeviceProfiles returns IDs of hardware profiles AVDs can be created with,
+// e.g. "pixel_7".
+func DeviceProfiles() ([]string, error) {
+	return DeviceProfilesContext(context.Background())
+}
+
+// DeviceProfilesContext is like DeviceProfiles but uses ctx to run
+// avdmanager.
+func DeviceProfilesContext(ctx context.Context) ([]string, error) {
+	output, err := CommandRunner.Run(ctx, LocateSDK().AVDManager(), "list", "device", "-c")
+	if err != nil {
+		return nil, fmt.Errorf("failed to run avdmanager: %w", err)
+	}
+
+	// Sample output:
+	// automotive_1024p_landscape
+	// pixel_7
+	// pixel_7_pro
+	//
+	// Warnings, e.g. "Warning: Observed package id ...", may come first.
+	var profiles []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.ContainsAny(line, " :") {
+			profiles = append(profiles, line)
+		}
+	}
+
+	return profiles, nil
 }
 
 func Skins() ([]string, error) {
 	var directories []string
 
-	androidHome := os.Getenv("ANDROID_HOME")
-	if androidHome == "" {
-		return nil, fmt.Errorf("ANDROID_HOME environment variable not set")
+	sdkRoot, err := LocateSDK().root()
+	if err != nil {
+		return nil, err
 	}
 
-	skinsPath := filepath.Join(androidHome, "skins")
+	skinsPath := filepath.Join(sdkRoot, "skins")
 
 	entries, err := os.ReadDir(skinsPath)
 	if err != nil {
-		return nil, fmt.Errorf("read directory %s: %v", skinsPath, err)
+		return nil, fmt.Errorf("read directory %s: %w", skinsPath, err)
 	}
 
 	for _, entry := range entries {
@@ -92,60 +350,63 @@ func Skins() ([]string, error) {
 	return directories, nil
 }
 
-// updateConfig updates the config.ini file to enable keyboard support.
-func updateConfig(avdDir string) error {
-	configIniPath := filepath.Join(avdDir, "config.ini")
+// avdNameRegexp matches names allowed by avdmanager.
+var avdNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
 
-	file, err := os.OpenFile(configIniPath, os.O_RDWR, os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("open config.ini file: %v", err)
-	}
-	defer file.Close()
+// defaultAVDName returns a name for a new AVD in avdHome running osimage on
+// device that isn't taken yet.
+func defaultAVDName(avdHome string, osimage SystemImage, device string) string {
+	base := cases.Title(language.English, cases.NoLower).String(device)
+	base = fmt.Sprint(base, "_API_", osimage.ApiLevel())
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimSpace(line)
-		// Values inspired by: https://garden.pacia.tech/managing-avd-from-terminal
-		if strings.HasPrefix(line, "hw.keyboard=no") {
-			lines = append(lines, "hw.keyboard=yes")
-		} else if strings.HasPrefix(line, "vm.heapSize=") {
-			lines = append(lines, "vm.heapSize=1024M")
-		} else if strings.HasPrefix(line, "hw.ramSize=") {
-			lines = append(lines, "hw.ramSize=4G")
-		} else {
-			lines = append(lines, line)
-		}
+	candidates := []string{base}
+	if tag := osimage.Tag(); tag != "" {
+		candidates = append(candidates, base+"_"+tag)
+		base += "_" + tag
 	}
-
-	err = scanner.Err()
-	if err != nil {
-		return fmt.Errorf("scanning %s: %v", configIniPath, err)
+	if abi := osimage.ABI(); abi != "" {
+		candidates = append(candidates, base+"_"+abi)
+		base += "_" + abi
 	}
 
-	err = os.Truncate(configIniPath, 0)
-	if err != nil {
-		return fmt.Errorf("truncating %s: %v", configIniPath, err)
+	for _, name := range candidates {
+		if !avdExists(avdHome, name) {
+			return name
+		}
 	}
 
-	_, err = file.Seek(0, 0)
-	if err != nil {
-		return fmt.Errorf("seeking %s: %v", configIniPath, err)
+	for i := 2; ; i++ {
+		name := fmt.Sprintf("%s_%d", base, i)
+		if !avdExists(avdHome, name) {
+			return name
+		}
 	}
+}
 
-	writer := bufio.NewWriter(file)
-	for _, line := range lines {
-		_, err := writer.WriteString(line + "\n")
-		if err != nil {
-			return fmt.Errorf("writing %s: %v", configIniPath, err)
+// avdExists reports whether an AVD with name, or its data, exists in
+// avdHome.
+func avdExists(avdHome, name string) bool {
+	for _, path := range []string{filepath.Join(avdHome, name+".ini"), filepath.Join(avdHome, name+".avd")} {
+		if _, err := os.Stat(path); err == nil {
+			return true
 		}
 	}
 
-	err = writer.Flush()
+	return false
+}
+
+// updateConfig applies settings to the config.ini file of the AVD at avdDir.
+func updateConfig(avdDir string, settings [][2]string) error {
+	configIniPath := filepath.Join(avdDir, "config.ini")
+
+	config, err := ini.Load(configIniPath)
 	if err != nil {
-		return fmt.Errorf("flushing %s: %v", configIniPath, err)
+		return err
+	}
+
+	for _, setting := range settings {
+		config.Set(setting[0], setting[1])
 	}
 
-	return nil
+	return config.Save(configIniPath)
 }
@@ -0,0 +1,205 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestDeleteAVD(t *testing.T) {
+	avdHome := useAVDHome(t, "Pixel_7_API_34", "Pixel_9_API_35")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	useFakeRunner(t, nil)
+
+	avdDir := filepath.Join(avdHome, "Pixel_7_API_34.avd")
+	err := os.MkdirAll(filepath.Join(avdDir, "snapshots"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(avdDir, "snapshots", "default_boot"), make([]byte, 1000), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := DeleteAVDSize(context.Background(), "Pixel_7_API_34")
+	if err != nil {
+		t.Fatalf("DeleteAVDSize() error: %v", err)
+	}
+	if size < 1000 {
+		t.Errorf("DeleteAVDSize() freed %d bytes, want at least 1000", size)
+	}
+
+	entries, err := os.ReadDir(avdHome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "Pixel_9_API_35.ini" {
+		t.Errorf("AVD home contains %v after delete, want only Pixel_9_API_35.ini", entries)
+	}
+
+	err = DeleteAVD("Pixel_7_API_34")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteAVD() of deleted AVD error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestDeleteAVDRunning(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("running emulators are faked with /proc")
+	}
+
+	avdHome := useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, writeProcRoot(t, map[string][]string{
+		"4242": {"/sdk/emulator/qemu/linux-x86_64/qemu-system-x86_64", "@Pixel_7_API_34"},
+	}))
+	useFakeRunner(t, nil)
+
+	err := DeleteAVD("Pixel_7_API_34")
+	if !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("DeleteAVD() error = %v, want %v", err, ErrAlreadyRunning)
+	}
+
+	_, err = os.Stat(filepath.Join(avdHome, "Pixel_7_API_34.ini"))
+	if err != nil {
+		t.Errorf("ini file of running AVD: %v", err)
+	}
+}
+
+// fakeAVDManager is a FakeRunner that creates the AVD directory with config
+// when avdmanager creates an AVD.
+type fakeAVDManager struct {
+	*FakeRunner
+	avdHome string
+	config  string
+}
+
+func (f *fakeAVDManager) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	out, err := f.FakeRunner.Run(ctx, name, args...)
+	if err != nil || name != "avdmanager" {
+		return out, err
+	}
+
+	i := slices.Index(args, "--name")
+	avdDir := filepath.Join(f.avdHome, args[i+1]+".avd")
+	err = os.MkdirAll(avdDir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, os.WriteFile(filepath.Join(avdDir, "config.ini"), []byte(f.config), 0o644)
+}
+
+// useFakeAVDManager makes avdmanager invocations of runner create AVDs in
+// avdHome with config.
+func useFakeAVDManager(t *testing.T, runner *FakeRunner, avdHome, config string) {
+	t.Helper()
+
+	prev := CommandRunner
+	CommandRunner = &fakeAVDManager{FakeRunner: runner, avdHome: avdHome, config: config}
+	t.Cleanup(func() { CommandRunner = prev })
+}
+
+func TestCreateAVDWithOptions(t *testing.T) {
+	avdHome := useAVDHome(t)
+	runner := useFakeRunner(t, nil)
+	useFakeAVDManager(t, runner, avdHome, "AvdId=Pixel_7_Play\nhw.lcd.density = 420\nhw.ramSize = 2048\n")
+	avdDir := filepath.Join(avdHome, "Pixel_7_Play.avd")
+
+	opts := CreateOptions{
+		Name:     "Pixel_7_Play",
+		Device:   "pixel_7",
+		SDCardMB: 512,
+		Cores:    4,
+		Config:   map[string]string{"hw.ramSize": "6G", "hw.initialOrientation": "landscape"},
+	}
+	name, path, err := CreateAVDWithOptions(context.Background(), "system-images;android-34;google_apis_playstore;x86_64", opts)
+	if err != nil {
+		t.Fatalf("CreateAVDWithOptions() error: %v", err)
+	}
+	if name != "Pixel_7_Play" || path != avdDir {
+		t.Errorf("CreateAVDWithOptions() = %q, %q, want %q, %q", name, path, "Pixel_7_Play", avdDir)
+	}
+
+	want := "avdmanager create avd --sdcard 512M --package system-images;android-34;google_apis_playstore;x86_64 --name Pixel_7_Play --device pixel_7"
+	if calls := runner.Calls(); !slices.Contains(calls, want) {
+		t.Errorf("invocations = %q, want %q", calls, want)
+	}
+
+	data, err := os.ReadFile(filepath.Join(avdDir, "config.ini"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "AvdId=Pixel_7_Play\nhw.lcd.density = 420\nhw.ramSize = 6G\nhw.keyboard=yes\nvm.heapSize=1024M\nhw.cpu.ncore=4\nhw.initialOrientation=landscape\n"
+	if string(data) != want {
+		t.Errorf("config.ini = %q, want %q", data, want)
+	}
+}
+
+func TestCreateAVDInvalidOptions(t *testing.T) {
+	useAVDHome(t)
+	runner := useFakeRunner(t, nil)
+
+	_, _, err := CreateAVDWithOptions(context.Background(), "system-images;android-34;google_apis;x86_64", CreateOptions{Device: "pixel_7", RAMSize: "lots"})
+	if err == nil {
+		t.Errorf("CreateAVDWithOptions() with invalid RAM size: error = nil, want error")
+	}
+	if calls := runner.Calls(); len(calls) != 0 {
+		t.Errorf("invocations = %q, want none", calls)
+	}
+}
+
+func TestCreateAVDNameCollision(t *testing.T) {
+	avdHome := useAVDHome(t, "Pixel_7_API_34", "Pixel_7_API_34_google_apis_playstore")
+	runner := useFakeRunner(t, nil)
+	useFakeAVDManager(t, runner, avdHome, "")
+
+	_, _, err := CreateAVDWithOptions(context.Background(), "system-images;android-34;google_apis;x86_64", CreateOptions{Name: "Pixel_7_API_34", Device: "pixel_7"})
+	if !errors.Is(err, ErrExists) {
+		t.Errorf("CreateAVDWithOptions() with taken name error = %v, want %v", err, ErrExists)
+	}
+	if calls := runner.Calls(); len(calls) != 0 {
+		t.Errorf("invocations = %q, want none", calls)
+	}
+
+	tests := []struct {
+		image SystemImage
+		want  string
+	}{
+		{image: "system-images;android-35;google_apis;x86_64", want: "Pixel_7_API_35"},
+		{image: "system-images;android-34;google_apis;x86_64", want: "Pixel_7_API_34_google_apis"},
+		{image: "system-images;android-34;google_apis_playstore;x86_64", want: "Pixel_7_API_34_google_apis_playstore_x86_64"},
+	}
+
+	for _, tt := range tests {
+		name, _, err := CreateAVDWithOptions(context.Background(), tt.image, CreateOptions{Device: "pixel_7"})
+		if err != nil {
+			t.Errorf("CreateAVDWithOptions(%s) error: %v", tt.image, err)
+			continue
+		}
+		if name != tt.want {
+			t.Errorf("CreateAVDWithOptions(%s) name = %q, want %q", tt.image, name, tt.want)
+		}
+	}
+}
+
+func TestDeviceProfiles(t *testing.T) {
+	useFakeRunner(t, map[string]string{
+		"avdmanager list device -c": "Warning: Observed package id 'emulator' in inconsistent location\n" +
+			"automotive_1024p_landscape\npixel_7\npixel_7_pro\n",
+	})
+
+	profiles, err := DeviceProfiles()
+	if err != nil {
+		t.Fatalf("DeviceProfiles() error: %v", err)
+	}
+
+	want := []string{"automotive_1024p_landscape", "pixel_7", "pixel_7_pro"}
+	if !slices.Equal(profiles, want) {
+		t.Errorf("DeviceProfiles() = %q, want %q", profiles, want)
+	}
+}
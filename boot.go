@@ -0,0 +1,258 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// bootPollInterval is how often the state of a booting emulator is checked.
+var bootPollInterval = time.Second
+
+// Emulator is an emulator process started by this package.
+type Emulator struct {
+	// Name of the AVD the emulator runs.
+	Name string
+
+	// LogPath is the path of the file the emulator's output is written to.
+	LogPath string
+
+	// Port is the console port the emulator was started with. Equals 0 if
+	// the emulator chooses it.
+	Port int
+
+	// logOffset is the size of the log file before the emulator was started.
+	logOffset int64
+
+	process Process
+
+	// knownSerials are serials of emulators that were running before this
+	// one was started.
+	knownSerials []string
+
+	done    chan struct{}
+	exitErr error
+}
+
+// BootError is returned when an emulator fails to boot.
+type BootError struct {
+	Name string
+	Err  error
+
+	// Output of the emulator until the failure.
+	Output string
+}
+
+func (e *BootError) Error() string {
+	return fmt.Sprintf("avd %s didn't boot: %v", e.Name, e.Err)
+}
+
+func (e *BootError) Unwrap() error {
+	return e.Err
+}
+
+// LogPath returns the path of the file that output of emulators running the
+// AVD with name is written to.
+func LogPath(name string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("get cache directory: %w", err)
+	}
+
+	return filepath.Join(dir, "emu", "logs", name+".log"), nil
+}
+
+// startEmulator starts the emulator with args for avd. Its output is written
+// to the log file and, if not nil, to opts.Output.
+func startEmulator(ctx context.Context, avd AVD, args []string, opts StartOptions) (*Emulator, error) {
+	output := opts.Output
+
+	logPath, err := LogPath(avd.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(logPath), 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("create log directory: %w", err)
+	}
+
+	// The log is appended to, because other instances of the AVD may still
+	// be writing to it.
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+
+	info, err := logFile.Stat()
+	if err != nil {
+		logFile.Close()
+		return nil, fmt.Errorf("stat log file: %w", err)
+	}
+
+	emu := &Emulator{
+		Name:      avd.Name,
+		LogPath:   logPath,
+		Port:      opts.Port,
+		logOffset: info.Size(),
+		done:      make(chan struct{}),
+	}
+	for _, instance := range avd.Instances {
+		if instance.Serial != "" {
+			emu.knownSerials = append(emu.knownSerials, instance.Serial)
+		}
+	}
+	if avd.Running {
+		// Ports of running instances may be unknown, so be safe and treat all
+		// devices as belonging to other instances.
+		serials, _ := DevicesContext(ctx)
+		emu.knownSerials = append(emu.knownSerials, serials...)
+	}
+
+	// If the output is only the log file, the emulator writes to it directly,
+	// so it can keep running after this program exits. Otherwise, the output
+	// is copied until the emulator exits.
+	var w io.Writer = logFile
+	if output != nil {
+		w = io.MultiWriter(logFile, output)
+	}
+
+	emu.process, err = CommandRunner.Start(ctx, w, LocateSDK().Emulator(), args...)
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	if output == nil {
+		logFile.Close()
+	}
+
+	go func() {
+		emu.exitErr = emu.process.Wait()
+		if output != nil {
+			logFile.Close()
+		}
+		close(emu.done)
+	}()
+
+	return emu, nil
+}
+
+// Pid returns the PID of the emulator process.
+func (e *Emulator) Pid() int {
+	return e.process.Pid()
+}
+
+// Signal sends sig to the emulator process.
+func (e *Emulator) Signal(sig os.Signal) error {
+	return e.process.Signal(sig)
+}
+
+// Wait waits for the emulator to exit.
+func (e *Emulator) Wait() error {
+	<-e.done
+	return e.exitErr
+}
+
+// Output returns what the emulator printed so far.
+func (e *Emulator) Output() (string, error) {
+	f, err := os.Open(e.LogPath)
+	if err != nil {
+		return "", fmt.Errorf("open log file: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.Seek(e.logOffset, io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("seek log file: %w", err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("read log file: %w", err)
+	}
+
+	return string(data), nil
+}
+
+// WaitForBoot waits until the emulator is attached to adb, has completed
+// booting, and its package manager is ready, and returns its device.
+//
+// If the emulator exits or ctx is done before that, the error is *BootError.
+func (e *Emulator) WaitForBoot(ctx context.Context) (Device, error) {
+	ticker := time.NewTicker(bootPollInterval)
+	defer ticker.Stop()
+
+	var device Device
+	for {
+		if device.Serial == "" {
+			device, _ = e.findDevice(ctx)
+		}
+
+		if device.Serial != "" && device.booted(ctx) {
+			return device, nil
+		}
+
+		select {
+		case <-e.done:
+			err := e.exitErr
+			if err == nil {
+				err = errors.New("emulator exited")
+			}
+			return Device{}, e.bootError(fmt.Errorf("emulator exited before booting: %w", err))
+		case <-ctx.Done():
+			return Device{}, e.bootError(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Emulator) bootError(err error) *BootError {
+	output, outputErr := e.Output()
+	if outputErr != nil {
+		output = outputErr.Error()
+	}
+
+	return &BootError{Name: e.Name, Err: err, Output: output}
+}
+
+// findDevice returns the device of this emulator, if it's attached to adb.
+func (e *Emulator) findDevice(ctx context.Context) (Device, error) {
+	serials, err := DevicesContext(ctx)
+	if err != nil {
+		return Device{}, err
+	}
+
+	for _, serial := range serials {
+		if !strings.HasPrefix(serial, "emulator-") || slices.Contains(e.knownSerials, serial) {
+			continue
+		}
+		if e.Port != 0 && serial != fmt.Sprintf("emulator-%d", e.Port) {
+			continue
+		}
+
+		name, err := AVDNameContext(ctx, serial)
+		if err == nil && name == e.Name {
+			return NewDevice(serial), nil
+		}
+	}
+
+	return Device{}, fmt.Errorf("%w: %s", ErrNotRunning, e.Name)
+}
+
+// booted reports whether the device completed booting and its package
+// manager is ready.
+func (d Device) booted(ctx context.Context) bool {
+	out, err := d.shellOutput(ctx, "getprop", "sys.boot_completed")
+	if err != nil || strings.TrimSpace(string(out)) != "1" {
+		return false
+	}
+
+	out, err = d.shellOutput(ctx, "pm", "path", "android")
+	return err == nil && strings.HasPrefix(strings.TrimSpace(string(out)), "package:")
+}
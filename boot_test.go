@@ -0,0 +1,125 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useBootPollInterval sets bootPollInterval to d for the duration of the
+// test.
+func useBootPollInterval(t *testing.T, d time.Duration) {
+	t.Helper()
+
+	prev := bootPollInterval
+	bootPollInterval = d
+	t.Cleanup(func() { bootPollInterval = prev })
+}
+
+func TestWaitForBoot(t *testing.T) {
+	useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	useBootPollInterval(t, time.Millisecond)
+	useFakeRunner(t, map[string]string{
+		"adb devices":                       "List of devices attached\nemulator-5554\tdevice\n\n",
+		"adb -s emulator-5554 emu avd name": "Pixel_7_API_34\r\nOK\r\n",
+		"adb -s emulator-5554 shell getprop sys.boot_completed": "1\n",
+		"adb -s emulator-5554 shell pm path android":            "package:/system/framework/framework-res.apk\n",
+	})
+
+	emu, err := StartWithOptions(context.Background(), "Pixel_7_API_34", StartOptions{})
+	if err != nil {
+		t.Fatalf("StartWithOptions() error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	device, err := emu.WaitForBoot(ctx)
+	if err != nil {
+		t.Fatalf("WaitForBoot() error: %v", err)
+	}
+	if device.Serial != "emulator-5554" {
+		t.Errorf("WaitForBoot() serial = %q, want %q", device.Serial, "emulator-5554")
+	}
+}
+
+func TestWaitForBootNotBooted(t *testing.T) {
+	useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	useBootPollInterval(t, time.Millisecond)
+	useFakeRunner(t, map[string]string{
+		"adb devices":                       "List of devices attached\nemulator-5554\tdevice\n\n",
+		"adb -s emulator-5554 emu avd name": "Pixel_7_API_34\r\nOK\r\n",
+		"adb -s emulator-5554 shell getprop sys.boot_completed": "\n",
+	})
+
+	emu, err := StartWithOptions(context.Background(), "Pixel_7_API_34", StartOptions{})
+	if err != nil {
+		t.Fatalf("StartWithOptions() error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = emu.WaitForBoot(ctx)
+	var bootErr *BootError
+	if !errors.As(err, &bootErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForBoot() error = %v, want *BootError wrapping %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestWaitForBootExited(t *testing.T) {
+	useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	useBootPollInterval(t, time.Millisecond)
+	runner := useFakeRunner(t, nil)
+	runner.Exits = map[string]error{
+		"emulator @Pixel_7_API_34 -no-boot-anim -no-audio": errors.New("exit status 1"),
+	}
+
+	logPath, err := LogPath("Pixel_7_API_34")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Dir(logPath), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(logPath, []byte("output of an earlier run\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emu, err := StartWithOptions(context.Background(), "Pixel_7_API_34", StartOptions{})
+	if err != nil {
+		t.Fatalf("StartWithOptions() error: %v", err)
+	}
+
+	// Pretend the emulator printed something before exiting.
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("PANIC: Missing emulator engine program\n")
+	f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = emu.WaitForBoot(ctx)
+	var bootErr *BootError
+	if !errors.As(err, &bootErr) {
+		t.Fatalf("WaitForBoot() error = %v, want *BootError", err)
+	}
+	if bootErr.Output != "PANIC: Missing emulator engine program\n" {
+		t.Errorf("BootError.Output = %q, want only output of this run", bootErr.Output)
+	}
+	if !strings.Contains(err.Error(), "exited") {
+		t.Errorf("WaitForBoot() error = %q, want it to mention the exit", err)
+	}
+}
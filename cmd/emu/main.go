@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"runtime"
+	"os/exec"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	emulator "github.com/bartekpacia/emu"
 	docs "github.com/urfave/cli-docs/v3"
@@ -19,6 +31,9 @@ const (
 	categoryUtilities = "Auxiliary utilities"
 )
 
+// cancelTimeout releases resources of the --timeout context.
+var cancelTimeout context.CancelFunc = func() {}
+
 // This is set by GoReleaser, see https://goreleaser.com/cookbooks/using-main.version
 var version = "dev"
 
@@ -33,15 +48,38 @@ func main() {
 		Version:               version,
 		EnableShellCompletion: true,
 		HideHelpCommand:       true,
+		Before: func(ctx context.Context, c *cli.Command) (context.Context, error) {
+			// Set here rather than in a flag action, which would run only
+			// after the Before actions of subcommands.
+			emulator.PrintInvocations = !c.Bool("quiet")
+
+			if timeout := c.Duration("timeout"); timeout > 0 {
+				ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+			}
+			return ctx, nil
+		},
+		After: func(ctx context.Context, c *cli.Command) error {
+			cancelTimeout()
+			return nil
+		},
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:    "quiet",
 				Aliases: []string{"q"},
 				Usage:   "do not print invocations of subprocesses",
-				Action: func(ctx context.Context, c *cli.Command, value bool) error {
-					emulator.PrintInvocations = !value
-					return nil
-				},
+			},
+			&cli.StringFlag{
+				Name:    "serial",
+				Aliases: []string{"s"},
+				Usage:   "use device with given serial",
+			},
+			&cli.StringFlag{
+				Name:  "avd",
+				Usage: "use running AVD with given name",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "abort if the command doesn't finish within this duration, e.g. 30s",
 			},
 		},
 		Commands: []*cli.Command{
@@ -50,14 +88,19 @@ func main() {
 			&fontsizeCommand,
 			&displaysizeCommand,
 			&animationsCommand,
+			&consoleCommand,
 			// manage
 			&createCommand,
 			&listCommand,
 			&runCommand,
+			&logsCommand,
 			&killCommand,
+			&restartCommand,
+			&configCommand,
 			&removeCommand,
 			// docs
 			&systemImagesCommand,
+			&doctorCommand,
 			&printDocsCommand,
 		},
 		CommandNotFound: func(ctx context.Context, c *cli.Command, command string) {
@@ -65,9 +108,77 @@ func main() {
 		},
 	}
 
-	err := root.Run(context.Background(), os.Args)
+	// Cancelling the context kills subprocesses started by the command. Once
+	// it's cancelled, signals are no longer caught, so that a second Ctrl-C
+	// exits right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+
+	err := root.Run(ctx, os.Args)
+	stop()
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// Exit codes, so that scripts can react to errors without parsing messages.
+const (
+	exitFailure          = 1
+	exitNotFound         = 3
+	exitAlreadyRunning   = 4
+	exitNotRunning       = 5
+	exitToolMissing      = 6
+	exitUnexpectedOutput = 7
+	exitExists           = 8
+)
+
+// exitStatusError is returned when a program run in the foreground exits
+// with an error, so that emu exits with the same code.
+type exitStatusError struct {
+	err  error
+	code int
+}
+
+func (e *exitStatusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitStatusError) Unwrap() error {
+	return e.err
+}
+
+// exitStatus returns the exit code of the exited program, or 128 plus the
+// signal number if it was killed by a signal, like shells do.
+func exitStatus(err *exec.ExitError) int {
+	status, ok := err.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return err.ExitCode()
+}
+
+// exitCode returns the exit code to exit the program with on err.
+func exitCode(err error) int {
+	var statusErr *exitStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.code
+	case errors.Is(err, emulator.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, emulator.ErrAlreadyRunning):
+		return exitAlreadyRunning
+	case errors.Is(err, emulator.ErrExists):
+		return exitExists
+	case errors.Is(err, emulator.ErrNotRunning):
+		return exitNotRunning
+	case errors.Is(err, emulator.ErrToolMissing):
+		return exitToolMissing
+	case errors.Is(err, emulator.ErrUnexpectedOutput):
+		return exitUnexpectedOutput
+	default:
+		return exitFailure
 	}
 }
 
@@ -77,107 +188,388 @@ var createCommand = cli.Command{
 	Category: categoryManage,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
-			Name:     "system-image",
-			Usage:    "Identifier of the system image to flash AVD with. Run 'sdkmanager --list_installed | grep system-images' to see what you have",
-			Required: true,
+			Name:  "system-image",
+			Usage: "Identifier of the system image to flash AVD with. Run 'emu system-images' to see what you have",
 			// ShellComplete: SystemImages()
 		},
 		&cli.StringFlag{
-			Name:     "device",
-			Aliases:  []string{"skin"},
-			Usage:    "Name of the device frame to use",
-			Required: true,
+			Name:  "api",
+			Usage: "API level of the system image, e.g. 35. The best installed image for this machine is used",
+		},
+		&cli.BoolFlag{
+			Name:  "install",
+			Usage: "Install the system image chosen with --api if it's missing, without asking",
+		},
+		&cli.StringFlag{
+			Name:  "device",
+			Usage: "Hardware profile of the AVD, e.g. pixel_7. Run 'avdmanager list device -c' to see available profiles",
+		},
+		&cli.StringFlag{
+			Name: "skin",
+			Usage: "Name of the device frame to show around the screen, from the skins directory of the SDK. " +
+				"Without --device, it's the deprecated alias of --device",
 			// ShellComplete: ls $ANDROID_HOME/skins
 		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "Name of the AVD. By default, it's derived from the device and API level, and the tag and ABI of the system image if that name is taken",
+		},
+		&cli.StringFlag{
+			Name:  "tag",
+			Usage: "Tag of the system image, e.g. google_apis or google_apis_playstore",
+		},
+		&cli.StringFlag{
+			Name:  "abi",
+			Usage: "ABI of the system image, e.g. arm64-v8a",
+		},
 		&cli.IntFlag{
 			Name:  "sdcard",
-			Usage: "Size of SD card",
+			Usage: "Size of SD card in megabytes, 0 for no SD card",
 			Value: 4096,
 			// ShellComplete: common sizes (4096M, 8192M)
 		},
+		&cli.StringFlag{
+			Name:  "ram",
+			Usage: "RAM size",
+			Value: "4G",
+		},
+		&cli.StringFlag{
+			Name:  "heap",
+			Usage: "Maximum heap size of an app",
+			Value: "1024M",
+		},
+		&cli.IntFlag{
+			Name:  "cores",
+			Usage: "Number of CPU cores",
+		},
+		&cli.StringFlag{
+			Name:  "data-partition",
+			Usage: "Size of the data partition, e.g. 8G",
+		},
+		&cli.StringFlag{
+			Name:  "gpu",
+			Usage: "GPU emulation mode, e.g. host or swiftshader_indirect",
+		},
+		&cli.BoolFlag{
+			Name:  "keyboard",
+			Usage: "Allow input from the host keyboard",
+			Value: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "config",
+			Usage: "Set a key of config.ini, e.g. hw.initialOrientation=landscape, can be repeated",
+		},
 	},
 	Action: func(ctx context.Context, c *cli.Command) error {
 		osImage := emulator.SystemImage(c.String("system-image"))
-		device := c.String("device")
-		sdcardSizeMB := int(c.Int("sdcard"))
+		api := c.String("api")
+		if osImage == "" && api == "" {
+			return fmt.Errorf("system image not specified, use --system-image or --api")
+		}
+		if osImage != "" && api != "" {
+			return fmt.Errorf("--system-image can't be used with --api")
+		}
+
+		// --skin used to be an alias of --device.
+		device, skin := c.String("device"), c.String("skin")
+		if device == "" && skin != "" {
+			log.Printf("warning: --skin without --device is deprecated, use --device %s", skin)
+			device, skin = skin, ""
+		}
+		if device == "" {
+			return fmt.Errorf("device not specified, use --device")
+		}
 
-		arch := "x86_64"
-		if runtime.GOARCH == "arm64" {
-			arch = "arm64-v8a"
+		profiles, err := emulator.DeviceProfilesContext(ctx)
+		if err != nil {
+			return fmt.Errorf("get device profiles: %w", err)
+		}
+		if !slices.Contains(profiles, device) {
+			return fmt.Errorf("could not find a device profile '%s', run 'avdmanager list device -c' to see available profiles", device)
 		}
-		_ = arch
 
-		systemImages, err := emulator.SystemImages()
+		systemImages, err := emulator.SystemImagesContext(ctx)
 		if err != nil {
 			return fmt.Errorf("get system images: %w", err)
 		}
 
-		validSystemImage := false
-		for _, systemImage := range systemImages {
-			if osImage == systemImage {
-				validSystemImage = true
-				break
+		if api != "" {
+			osImage, err = emulator.SelectSystemImage(systemImages, api, c.String("tag"), c.String("abi"))
+			if err != nil {
+				osImage, err = installSystemImage(ctx, c, api, err)
+				if err != nil {
+					return err
+				}
+				systemImages = append(systemImages, osImage)
 			}
 		}
 
-		if !validSystemImage {
+		if !slices.Contains(systemImages, osImage) {
 			return fmt.Errorf("could not find a OS image '%s'", osImage)
 		}
 
-		skins, err := emulator.Skins()
-		if err != nil {
-			return fmt.Errorf("get skins: %w", err)
+		if osImage.ABI() != emulator.HostABI() {
+			log.Printf("warning: system image %s doesn't match host ABI %s, so the AVD will be slow or won't boot", osImage, emulator.HostABI())
+		}
+
+		if skin != "" {
+			skins, err := emulator.Skins()
+			if err != nil {
+				return fmt.Errorf("get skins: %w", err)
+			}
+
+			if !slices.Contains(skins, skin) {
+				return fmt.Errorf("could not find a valid skin '%s'", skin)
+			}
 		}
 
-		validSkin := false
-		for _, skin := range skins {
-			if device == skin {
-				validSkin = true
-				break
+		config := make(map[string]string)
+		for _, setting := range c.StringSlice("config") {
+			key, value, ok := strings.Cut(setting, "=")
+			if !ok {
+				return fmt.Errorf("invalid --config %q, must be key=value", setting)
 			}
+			config[key] = value
 		}
 
-		if !validSkin {
-			return fmt.Errorf("could not find a valid skin '%s'", device)
+		opts := emulator.CreateOptions{
+			Name:              c.String("name"),
+			Device:            device,
+			Skin:              skin,
+			Tag:               c.String("tag"),
+			ABI:               c.String("abi"),
+			SDCardMB:          int(c.Int("sdcard")),
+			RAMSize:           c.String("ram"),
+			HeapSize:          c.String("heap"),
+			Cores:             int(c.Int("cores")),
+			DataPartitionSize: c.String("data-partition"),
+			GPU:               c.String("gpu"),
+			NoKeyboard:        !c.Bool("keyboard"),
+			Config:            config,
 		}
 
-		avdName, avdPath, err := emulator.CreateAVD(osImage, device, sdcardSizeMB)
+		avdName, avdPath, err := emulator.CreateAVDWithOptions(ctx, osImage, opts)
 		if err != nil {
 			return fmt.Errorf("create AVD: %w", err)
 		}
 
-		_, _ = avdName, avdPath
-
+		fmt.Printf("Created AVD %s at %s\n", avdName, avdPath)
 		return nil
 	},
 }
 
 var runCommand = cli.Command{
 	Name:      "run",
-	Usage:     "Boot AVD",
-	ArgsUsage: "<avd>",
+	Usage:     "Boot AVDs",
+	ArgsUsage: "<avd>... [-- <emulator args>...]",
 	Category:  categoryManage,
+	Description: "Several AVDs are booted in parallel, each on its own console port.\n" +
+		"Arguments after -- are passed to every emulator.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "boot all AVDs that aren't running",
+		},
+		&cli.StringFlag{
+			Name:  "match",
+			Usage: "boot AVDs with names matching a glob pattern, e.g. 'Pixel_*'",
+		},
+		&cli.BoolFlag{
+			Name:  "no-window",
+			Usage: "run headless, without a window",
+		},
+		&cli.BoolFlag{
+			Name:  "cold",
+			Usage: "cold boot instead of loading the quickboot snapshot",
+		},
+		&cli.BoolFlag{
+			Name:  "wipe-data",
+			Usage: "reset user data of the AVD before booting",
+		},
+		&cli.IntFlag{
+			Name:  "port",
+			Usage: "console port, an even number between 5554 and 5682; adb uses port+1",
+		},
+		&cli.StringFlag{
+			Name:  "gpu",
+			Usage: "GPU emulation mode, e.g. host, swiftshader_indirect, or auto",
+		},
+		&cli.IntFlag{
+			Name:  "memory",
+			Usage: "RAM size in megabytes",
+		},
+		&cli.IntFlag{
+			Name:  "cores",
+			Usage: "number of CPU cores",
+		},
+		&cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "don't save changes to the AVD, allows running more instances of the same AVD",
+		},
+		&cli.BoolFlag{
+			Name:  "writable-system",
+			Usage: "make the system image writable",
+		},
+		&cli.StringFlag{
+			Name:  "http-proxy",
+			Usage: "proxy for all TCP connections, e.g. http://proxy.example.com:3128",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-server",
+			Usage: "DNS server to use instead of the host's, can be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "camera-back",
+			Usage: "source of the back camera, e.g. emulated, webcam0, or none",
+		},
+		&cli.StringFlag{
+			Name:  "camera-front",
+			Usage: "source of the front camera, e.g. emulated, webcam0, or none",
+		},
+		&cli.StringFlag{
+			Name:  "netspeed",
+			Usage: "network speed, e.g. full, lte, or <up>:<down> in kbit/s",
+		},
+		&cli.StringFlag{
+			Name:  "netdelay",
+			Usage: "network latency, e.g. none, gprs, or <min>:<max> in ms",
+		},
+		&cli.BoolFlag{
+			Name:  "wait",
+			Usage: "wait until AVDs have booted and print their serials, use --timeout to limit waiting",
+		},
+		&cli.BoolFlag{
+			Name:    "foreground",
+			Aliases: []string{"f"},
+			Usage:   "stay attached and print output of the emulator until it exits, Ctrl-C stops it",
+		},
+	},
 	Action: func(ctx context.Context, c *cli.Command) error {
-		avd := c.Args().First()
-		if avd == "" {
+		names, passthrough := splitRunArgs(c.Args().Slice())
+		names, err := matchAVDs(ctx, names, c.Bool("all"), c.String("match"))
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 && c.Bool("all") {
+			return fmt.Errorf("%w: all avds are running", emulator.ErrAlreadyRunning)
+		}
+		if len(names) == 0 {
 			return fmt.Errorf("avd not specified")
 		}
 
-		err := emulator.Start(avd)
+		opts := emulator.StartOptions{
+			NoWindow:       c.Bool("no-window"),
+			ColdBoot:       c.Bool("cold"),
+			WipeData:       c.Bool("wipe-data"),
+			Port:           int(c.Int("port")),
+			GPU:            c.String("gpu"),
+			RAMSize:        int(c.Int("memory")),
+			Cores:          int(c.Int("cores")),
+			ReadOnly:       c.Bool("read-only"),
+			WritableSystem: c.Bool("writable-system"),
+			HTTPProxy:      c.String("http-proxy"),
+			DNSServers:     c.StringSlice("dns-server"),
+			CameraBack:     c.String("camera-back"),
+			CameraFront:    c.String("camera-front"),
+			NetSpeed:       c.String("netspeed"),
+			NetDelay:       c.String("netdelay"),
+			Args:           passthrough,
+		}
+
+		// AVDs chosen with --all or --match are reported in a table, even if
+		// there's one, so that the output doesn't depend on how many matched.
+		many := len(names) > 1 || c.Bool("all") || c.String("match") != ""
+
+		foreground := c.Bool("foreground")
+		if foreground && c.Bool("wait") {
+			return fmt.Errorf("--wait can't be used with --foreground")
+		}
+		if foreground && many {
+			return fmt.Errorf("--foreground can't be used with more than one avd, --all, or --match")
+		}
+		if foreground {
+			opts.Output = &prefixWriter{prefix: names[0] + " | ", w: os.Stdout}
+		}
+
+		if !many {
+			emu, err := emulator.StartWithOptions(ctx, names[0], opts)
+			if err != nil {
+				return fmt.Errorf("failed to start emulator: %w", err)
+			}
+
+			if foreground {
+				return runForeground(emu)
+			}
+
+			if !c.Bool("wait") {
+				return nil
+			}
+
+			device, err := emu.WaitForBoot(ctx)
+			if err != nil {
+				printBootOutput(emu, err)
+				return err
+			}
+
+			fmt.Println(device.Serial)
+			return nil
+		}
+
+		emus, startErr := emulator.StartMany(ctx, names, opts)
+		if len(emus) == 0 {
+			return fmt.Errorf("failed to start emulators: %w", startErr)
+		}
+
+		statuses := make([]string, len(emus))
+		bootErrs := make([]error, len(emus))
+		if c.Bool("wait") {
+			var wg sync.WaitGroup
+			for i, emu := range emus {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					_, bootErrs[i] = emu.WaitForBoot(ctx)
+				}()
+			}
+			wg.Wait()
+		}
+
+		for i, emu := range emus {
+			switch {
+			case !c.Bool("wait"):
+				statuses[i] = "booting"
+			case bootErrs[i] != nil:
+				printBootOutput(emu, bootErrs[i])
+				statuses[i] = "failed"
+			default:
+				statuses[i] = "booted"
+			}
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "AVD\tSERIAL\tSTATUS\n")
+		for i, emu := range emus {
+			fmt.Fprintf(w, "%s\temulator-%d\t%s\n", emu.Name, emu.Port, statuses[i])
+		}
+		err = w.Flush()
 		if err != nil {
-			return fmt.Errorf("failed to start emulator: %v", err)
+			return err
 		}
 
-		return nil
+		return errors.Join(append([]error{startErr}, bootErrs...)...)
 	},
 	ShellComplete: func(ctx context.Context, c *cli.Command) {
-		avds, err := emulator.List()
+		avds, err := emulator.ListContext(ctx)
 		if err != nil {
 			return
 		}
 
 		for _, avd := range avds {
-			if avd.Running {
+			if avd.Running && !c.Bool("read-only") {
+				continue
+			}
+			if slices.Contains(c.Args().Slice(), avd.Name) {
 				continue
 			}
 
@@ -186,16 +578,204 @@ var runCommand = cli.Command{
 	},
 }
 
+// splitRunArgs splits arguments of the run command into AVD names and
+// arguments for the emulator, which come after "--" and start with "-".
+func splitRunArgs(args []string) (names, passthrough []string) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			return args[:i:i], args[i:]
+		}
+	}
+
+	return args, nil
+}
+
+// matchAVDs returns names, followed by names of AVDs matching pattern and,
+// if all is true, of all AVDs that aren't running, without duplicates.
+func matchAVDs(ctx context.Context, names []string, all bool, pattern string) ([]string, error) {
+	var unique []string
+	for _, name := range names {
+		if !slices.Contains(unique, name) {
+			unique = append(unique, name)
+		}
+	}
+	names = unique
+
+	if !all && pattern == "" {
+		return names, nil
+	}
+
+	avds, err := emulator.ListContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list avds: %w", err)
+	}
+
+	matched := false
+	for _, avd := range avds {
+		ok := all && !avd.Running
+		if pattern != "" {
+			match, err := path.Match(pattern, avd.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			matched = matched || match
+			ok = ok || match
+		}
+
+		if ok && !slices.Contains(names, avd.Name) {
+			names = append(names, avd.Name)
+		}
+	}
+
+	if pattern != "" && !matched {
+		return nil, fmt.Errorf("%w: no avd matches %q", emulator.ErrNotFound, pattern)
+	}
+
+	return names, nil
+}
+
+// printBootOutput prints output of emu if it failed to boot with err.
+func printBootOutput(emu *emulator.Emulator, err error) {
+	var bootErr *emulator.BootError
+	if errors.As(err, &bootErr) && bootErr.Output != "" {
+		fmt.Fprintf(os.Stderr, "emulator output of avd %s (%s):\n%s\n", emu.Name, emu.LogPath, strings.TrimRight(bootErr.Output, "\n"))
+	}
+}
+
+// runForeground forwards SIGINT and SIGTERM to emu until it exits.
+func runForeground(emu *emulator.Emulator) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	exited := make(chan error, 1)
+	go func() { exited <- emu.Wait() }()
+
+	for {
+		select {
+		case sig := <-signals:
+			err := emu.Signal(sig)
+			if err != nil {
+				log.Printf("forward %v to emulator: %v", sig, err)
+			}
+		case err := <-exited:
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return &exitStatusError{err: fmt.Errorf("emulator of avd %s exited: %w", emu.Name, err), code: exitStatus(exitErr)}
+			}
+			return err
+		}
+	}
+}
+
+var logsCommand = cli.Command{
+	Name:      "logs",
+	Usage:     "Print output of the emulator running an AVD",
+	ArgsUsage: "<avd>",
+	Category:  categoryManage,
+	Description: "Prints the log file that output of emulators started with 'emu run' is written to.\n" +
+		"Output of every run is appended to it.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "follow",
+			Aliases: []string{"f"},
+			Usage:   "keep printing output as it's written, until Ctrl-C",
+		},
+		&cli.BoolFlag{
+			Name:  "path",
+			Usage: "print path of the log file instead of its content",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		avd := c.Args().First()
+		if avd == "" {
+			return fmt.Errorf("avd not specified")
+		}
+
+		logPath, err := emulator.LogPath(avd)
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("path") {
+			fmt.Println(logPath)
+			return nil
+		}
+
+		f, err := os.Open(logPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no logs of avd %s, it wasn't started with 'emu run'", avd)
+		}
+		if err != nil {
+			return fmt.Errorf("open log file: %w", err)
+		}
+		defer f.Close()
+
+		for {
+			_, err = io.Copy(os.Stdout, f)
+			if err != nil {
+				return fmt.Errorf("read log file: %w", err)
+			}
+
+			if !c.Bool("follow") {
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	},
+	ShellComplete: func(ctx context.Context, c *cli.Command) {
+		if c.NArg() > 0 {
+			return
+		}
+
+		avds, err := emulator.ListContext(ctx)
+		if err != nil {
+			return
+		}
+
+		for _, avd := range avds {
+			fmt.Println(avd.Name)
+		}
+	},
+}
+
 var listCommand = cli.Command{
 	Name:            "list",
 	Aliases:         []string{"ls"},
 	Usage:           "List all AVDs",
 	Category:        categoryManage,
 	HideHelpCommand: true,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "long",
+			Aliases: []string{"l"},
+			Usage:   "also print target and path of each AVD, and its running instances",
+		},
+	},
 	Action: func(ctx context.Context, c *cli.Command) error {
-		avds, err := emulator.List()
+		avds, err := emulator.ListContext(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to list avds: %v", err)
+			return fmt.Errorf("failed to list avds: %w", err)
+		}
+
+		if c.Bool("long") {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for _, avd := range avds {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", avd.Describe(), avd.Target, avd.Path)
+				for _, instance := range avd.Instances {
+					mode := ""
+					if instance.ReadOnly {
+						mode = "read-only"
+					}
+					fmt.Fprintf(w, "  pid %d\t%s\t%s\n", instance.Pid, instance.Serial, mode)
+				}
+			}
+			return w.Flush()
 		}
 
 		for _, avd := range avds {
@@ -207,73 +787,349 @@ var listCommand = cli.Command{
 }
 
 var killCommand = cli.Command{
-	Name:     "kill",
-	Usage:    "Kill running AVDs",
-	Category: categoryManage,
+	Name:      "kill",
+	Usage:     "Stop running AVDs",
+	ArgsUsage: "<avd>...",
+	Category:  categoryManage,
+	Description: "Asks emulators to shut down, so that they save their quickboot snapshots.\n" +
+		"Emulators that don't exit in time are sent SIGTERM, and then SIGKILL.\n\n" +
+		"If several instances of an AVD are running, choose the one to stop with\n" +
+		"--pid or --serial.",
 	Flags: []cli.Flag{
-		&cli.StringFlag{
+		&cli.BoolFlag{
 			Name:    "all",
 			Aliases: []string{"a"},
-			Usage:   "kill all emulators",
+			Usage:   "stop all running emulators",
+		},
+		&cli.IntFlag{
+			Name:  "pid",
+			Usage: "stop the instance with given PID",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "kill with SIGKILL right away, the quickboot snapshot isn't saved and user data may be corrupted",
+		},
+		&cli.DurationFlag{
+			Name:  "grace-period",
+			Usage: "how long to wait for emulators to shut down before sending SIGTERM",
+			Value: 20 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "term-timeout",
+			Usage: "how long to wait for emulators to exit after SIGTERM before sending SIGKILL",
+			Value: 10 * time.Second,
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		names := c.Args().Slice()
+		if len(names) == 0 && !c.Bool("all") {
+			return fmt.Errorf("avd not specified")
+		}
+
+		avds, err := emulator.ListContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list avds: %w", err)
+		}
+
+		var instances []emulator.Instance
+		if c.Bool("all") {
+			for _, avd := range avds {
+				instances = append(instances, avd.Instances...)
+			}
+		}
+
+		for _, name := range names {
+			i := slices.IndexFunc(avds, func(avd emulator.AVD) bool { return avd.Name == name })
+			if i == -1 {
+				return fmt.Errorf("%w: %s", emulator.ErrNotFound, name)
+			}
+
+			instance, err := selectInstance(avds[i], int(c.Int("pid")), c.String("serial"))
+			if err != nil {
+				return err
+			}
+			if !slices.ContainsFunc(instances, func(i emulator.Instance) bool { return i.Pid == instance.Pid }) {
+				instances = append(instances, instance)
+			}
+		}
+
+		opts := emulator.StopOptions{
+			Force:       c.Bool("force"),
+			GracePeriod: c.Duration("grace-period"),
+			TermTimeout: c.Duration("term-timeout"),
+		}
+
+		errs := make([]error, len(instances))
+		var wg sync.WaitGroup
+		for i, instance := range instances {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				err := instance.Stop(ctx, opts)
+				if err != nil {
+					errs[i] = fmt.Errorf("failed to stop emulator %d: %w", instance.Pid, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		return errors.Join(errs...)
+	},
+	ShellComplete: func(ctx context.Context, c *cli.Command) {
+		avds, err := emulator.ListContext(ctx)
+		if err != nil {
+			return
+		}
+
+		for _, avd := range avds {
+			if !avd.Running || slices.Contains(c.Args().Slice(), avd.Name) {
+				continue
+			}
+
+			fmt.Println(avd.Name)
+		}
+	},
+}
+
+var restartCommand = cli.Command{
+	Name:      "restart",
+	Usage:     "Restart a running AVD",
+	ArgsUsage: "<avd>",
+	Category:  categoryManage,
+	Description: "Stops the AVD like 'emu kill' and boots it again with the arguments it was\n" +
+		"started with, except for -wipe-data and -no-snapshot-load.\n\n" +
+		"If several instances of the AVD are running, choose the one to restart with\n" +
+		"--pid or --serial.",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "pid",
+			Usage: "restart the instance with given PID",
+		},
+		&cli.BoolFlag{
+			Name:  "cold",
+			Usage: "cold boot instead of loading the quickboot snapshot",
+		},
+		&cli.BoolFlag{
+			Name:  "wipe-data",
+			Usage: "reset user data of the AVD before booting",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "kill with SIGKILL right away, the quickboot snapshot isn't saved and user data may be corrupted",
+		},
+		&cli.BoolFlag{
+			Name:  "wait",
+			Usage: "wait until the AVD has booted and print its serial, use --timeout to limit waiting",
 		},
 	},
 	Action: func(ctx context.Context, c *cli.Command) error {
 		avdName := c.Args().First()
+		if avdName == "" {
+			return fmt.Errorf("avd not specified")
+		}
+
+		avd, err := findAVD(ctx, avdName)
+		if err != nil {
+			return err
+		}
+
+		instance, err := selectInstance(avd, int(c.Int("pid")), c.String("serial"))
+		if err != nil {
+			return err
+		}
+
+		opts := emulator.RestartOptions{
+			Stop:     emulator.StopOptions{Force: c.Bool("force")},
+			ColdBoot: c.Bool("cold"),
+			WipeData: c.Bool("wipe-data"),
+		}
+		emu, err := avd.Restart(ctx, instance, opts)
+		if err != nil {
+			return fmt.Errorf("failed to restart emulator: %w", err)
+		}
+
+		if !c.Bool("wait") {
+			return nil
+		}
+
+		device, err := emu.WaitForBoot(ctx)
+		if err != nil {
+			printBootOutput(emu, err)
+			return err
+		}
+
+		fmt.Println(device.Serial)
+		return nil
+	},
+	ShellComplete: func(ctx context.Context, c *cli.Command) {
+		if c.NArg() > 0 {
+			return
+		}
+
+		avds, err := emulator.ListContext(ctx)
+		if err != nil {
+			return
+		}
+
+		for _, avd := range avds {
+			if avd.Running {
+				fmt.Println(avd.Name)
+			}
+		}
+	},
+}
 
+var configCommand = cli.Command{
+	Name:        "config",
+	Usage:       "Get or set hardware settings of an AVD",
+	ArgsUsage:   "<avd> [key] [value]",
+	Category:    categoryManage,
+	Description: configDescription(),
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "list",
+			Aliases: []string{"l"},
+			Usage:   "print all settings",
+		},
+		&cli.BoolFlag{
+			Name:  "unset",
+			Usage: "remove the setting, so that the emulator uses its default",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		avdName := c.Args().First()
 		if avdName == "" {
 			return fmt.Errorf("avd not specified")
 		}
+		key := c.Args().Get(1)
+		if key == "" && c.Bool("unset") {
+			return fmt.Errorf("key not specified")
+		}
 
-		avds, err := emulator.List()
+		avd, err := findAVD(ctx, avdName)
 		if err != nil {
-			return fmt.Errorf("failed to list avds: %v", err)
+			return err
 		}
 
-		for _, avd := range avds {
-			if avd.Name == avdName {
-				if !avd.Running {
-					return fmt.Errorf("avd '%s' is not running", avdName)
-				}
+		switch {
+		case c.Bool("list") || key == "":
+			config, err := avd.Config()
+			if err != nil {
+				return err
+			}
 
-				err := syscall.Kill(avd.Pid, syscall.SIGKILL)
-				if err != nil {
-					return fmt.Errorf("failed to kill avd %#v: %v", avdName, err)
-				}
-				return nil
+			for _, key := range config.Keys() {
+				fmt.Printf("%s=%s\n", key, config.Value(key))
+			}
+			return nil
+		case c.Bool("unset"):
+			return avd.UnsetConfig(key)
+		case c.NArg() > 2:
+			return avd.SetConfig(key, strings.Join(c.Args().Slice()[2:], " "))
+		default:
+			config, err := avd.Config()
+			if err != nil {
+				return err
 			}
-		}
 
-		return fmt.Errorf("avd '%s' not found", avdName)
+			value, ok := config.Get(key)
+			if !ok {
+				return fmt.Errorf("%s isn't set in config of avd %s", key, avdName)
+			}
+
+			fmt.Println(value)
+			return nil
+		}
 	},
 	ShellComplete: func(ctx context.Context, c *cli.Command) {
-		avds, err := emulator.List()
-		if err != nil {
-			return
-		}
+		switch c.NArg() {
+		case 0:
+			avds, err := emulator.ListContext(ctx)
+			if err != nil {
+				return
+			}
 
-		for _, avd := range avds {
-			if !avd.Running {
-				continue
+			for _, avd := range avds {
+				fmt.Println(avd.Name)
+			}
+		case 1:
+			var keys []string
+			for _, key := range emulator.ConfigKeys {
+				keys = append(keys, key.Name)
 			}
 
-			fmt.Println(avd.Name)
+			avd, err := findAVD(ctx, c.Args().First())
+			if err == nil {
+				if config, err := avd.Config(); err == nil {
+					keys = append(keys, config.Keys()...)
+				}
+			}
+
+			slices.Sort(keys)
+			for _, key := range slices.Compact(keys) {
+				fmt.Println(key)
+			}
+		case 2:
+			for _, key := range emulator.ConfigKeys {
+				if key.Name != c.Args().Get(1) {
+					continue
+				}
+
+				values := key.Values
+				if key.Type == emulator.ConfigBool {
+					values = []string{"yes", "no"}
+				}
+				for _, value := range values {
+					fmt.Println(value)
+				}
+			}
 		}
 	},
 }
 
+// configDescription returns the description of the config command, which
+// lists known settings.
+func configDescription() string {
+	var b strings.Builder
+	b.WriteString("Without a key, prints all settings. With a key, prints its value, and with a\n")
+	b.WriteString("value, sets it. The AVD must not be running while its settings are changed.\n\n")
+	b.WriteString("Values of these settings are validated:\n")
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, key := range emulator.ConfigKeys {
+		fmt.Fprintf(w, "  %s\t%s\n", key.Name, key.Description)
+	}
+	w.Flush()
+
+	return strings.TrimRight(b.String(), "\n")
+}
+
 var removeCommand = cli.Command{
-	Name:     "remove",
-	Aliases:  []string{"rm"},
-	Usage:    "Delete the Android Virtual Device and all associated data",
-	Category: categoryManage,
+	Name:      "remove",
+	Aliases:   []string{"rm"},
+	Usage:     "Delete Android Virtual Devices and all associated data",
+	ArgsUsage: "<avd>...",
+	Category:  categoryManage,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "stop running AVDs before deleting them",
+		},
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "don't ask for confirmation",
+		},
+	},
 	ShellComplete: func(ctx context.Context, c *cli.Command) {
-		avds, err := emulator.List()
+		avds, err := emulator.ListContext(ctx)
 		if err != nil {
 			return
 		}
 
 		for _, avd := range avds {
-			if avd.Running {
+			if (avd.Running && !c.Bool("force")) || slices.Contains(c.Args().Slice(), avd.Name) {
 				continue
 			}
 
@@ -281,14 +1137,57 @@ var removeCommand = cli.Command{
 		}
 	},
 	Action: func(ctx context.Context, c *cli.Command) error {
-		if c.NArg() != 1 {
-			return fmt.Errorf("invalid number of arguments (only 1 expected)")
+		if c.NArg() == 0 {
+			return fmt.Errorf("avd not specified")
 		}
 
-		avdName := c.Args().First()
-		err := emulator.DeleteAVD(avdName)
-		if err != nil {
-			return fmt.Errorf("delete AVD '%s': %v", avdName, err)
+		var avds []emulator.AVD
+		for _, name := range c.Args().Slice() {
+			avd, err := findAVD(ctx, name)
+			if err != nil {
+				return err
+			}
+			if avd.Running && !c.Bool("force") {
+				return fmt.Errorf("%w: %s, stop it with 'emu kill' or use --force", emulator.ErrAlreadyRunning, name)
+			}
+			avds = append(avds, avd)
+		}
+
+		if !c.Bool("yes") {
+			names := make([]string, len(avds))
+			for i, avd := range avds {
+				names[i] = avd.Name
+			}
+
+			ok, err := confirm(ctx, fmt.Sprintf("Delete %s and all their data?", strings.Join(names, ", ")))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("aborted")
+			}
+		}
+
+		var freed int64
+		for _, avd := range avds {
+			for _, instance := range avd.Instances {
+				err := instance.Stop(ctx, emulator.StopOptions{})
+				if err != nil {
+					return fmt.Errorf("stop avd %s: %w", avd.Name, err)
+				}
+			}
+
+			size, err := emulator.DeleteAVDSize(ctx, avd.Name)
+			if err != nil {
+				return fmt.Errorf("delete AVD '%s': %w", avd.Name, err)
+			}
+
+			freed += size
+			fmt.Printf("Deleted %s (%s)\n", avd.Name, formatBytes(size))
+		}
+
+		if len(avds) > 1 {
+			fmt.Printf("Freed %s\n", formatBytes(freed))
 		}
 
 		return nil
@@ -300,37 +1199,41 @@ var themeCommand = cli.Command{
 	Usage:           "Switch between light and dark mode",
 	Category:        categoryControl,
 	HideHelpCommand: true,
-	Flags: []cli.Flag{
-		&cli.StringFlag{
-			Name:    "serial",
-			Aliases: []string{"s"},
-			Usage:   "use device with given serial",
-			Action: func(ctx context.Context, c *cli.Command, value string) error {
-				emulator.Serial = value
-				return nil
-			},
-		},
-	},
 	Commands: []*cli.Command{
 		{
-			Name:  "light",
-			Usage: "Enables light theme",
+			Name:   "light",
+			Usage:  "Enables light theme",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.DisableDarkTheme()
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.DisableDarkThemeContext(ctx)
 			},
 		},
 		{
-			Name:  "dark",
-			Usage: "Enables dark theme",
+			Name:   "dark",
+			Usage:  "Enables dark theme",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.EnableDarkTheme()
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.EnableDarkThemeContext(ctx)
 			},
 		},
 		{
-			Name:  "toggle",
-			Usage: "Toggles between light and dark theme",
+			Name:   "toggle",
+			Usage:  "Toggles between light and dark theme",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.ToggleDarkTheme()
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.ToggleDarkThemeContext(ctx)
 			},
 		},
 	},
@@ -343,31 +1246,51 @@ var fontsizeCommand = cli.Command{
 	HideHelpCommand: true,
 	Commands: []*cli.Command{
 		{
-			Name:  "small",
-			Usage: "Sets font scale to 0.85",
+			Name:   "small",
+			Usage:  "Sets font scale to 0.85",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.SetFontSize("0.85")
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.SetFontSizeContext(ctx, "0.85")
 			},
 		},
 		{
-			Name:  "default",
-			Usage: "Sets font scale to 1.0",
+			Name:   "default",
+			Usage:  "Sets font scale to 1.0",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.SetFontSize("1.0")
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.SetFontSizeContext(ctx, "1.0")
 			},
 		},
 		{
-			Name:  "large",
-			Usage: "Sets font scale to 1.15",
+			Name:   "large",
+			Usage:  "Sets font scale to 1.15",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.SetFontSize("1.15")
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.SetFontSizeContext(ctx, "1.15")
 			},
 		},
 		{
-			Name:  "largest",
-			Usage: "Sets font scale to 1.30",
+			Name:   "largest",
+			Usage:  "Sets font scale to 1.30",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.SetFontSize("1.30")
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.SetFontSizeContext(ctx, "1.30")
 			},
 		},
 	},
@@ -381,42 +1304,67 @@ var displaysizeCommand = cli.Command{
 	Commands: []*cli.Command{
 		{
 			// e.g. 136
-			Name:  "small",
-			Usage: "Sets display size to default * 0.85",
+			Name:   "small",
+			Usage:  "Sets display size to default * 0.85",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.SetDisplaySize(0.85)
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.SetDisplaySizeContext(ctx, 0.85)
 			},
 		},
 		{
 			// e.g. 160
-			Name:  "default",
-			Usage: "Sets display size to default",
+			Name:   "default",
+			Usage:  "Sets display size to default",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.SetDisplaySize(1.0)
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.SetDisplaySizeContext(ctx, 1.0)
 			},
 		},
 		{
 			// e.g. 186
-			Name:  "large",
-			Usage: "Sets display size to default * 1.1625",
+			Name:   "large",
+			Usage:  "Sets display size to default * 1.1625",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.SetDisplaySize(1.1625)
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.SetDisplaySizeContext(ctx, 1.1625)
 			},
 		},
 		{
 			// e.g. 212
-			Name:  "largest",
-			Usage: "Sets display size to default * 1.325",
+			Name:   "largest",
+			Usage:  "Sets display size to default * 1.325",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.SetDisplaySize(1.325)
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.SetDisplaySizeContext(ctx, 1.325)
 			},
 		},
 		{
 			// e.g. 240
-			Name:  "ultra",
-			Usage: "Sets font scale to default * 1.5",
+			Name:   "ultra",
+			Usage:  "Sets font scale to default * 1.5",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.SetDisplaySize(1.5)
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.SetDisplaySizeContext(ctx, 1.5)
 			},
 		},
 	},
@@ -429,35 +1377,140 @@ var animationsCommand = cli.Command{
 	HideHelpCommand: true,
 	Commands: []*cli.Command{
 		{
-			Name:  "off",
-			Usage: "Disables animations",
+			Name:   "off",
+			Usage:  "Disables animations",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.DisableAnimations()
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.DisableAnimationsContext(ctx)
 			},
 		},
 		{
-			Name:  "on",
-			Usage: "Enables animation",
+			Name:   "on",
+			Usage:  "Enables animation",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.EnableAnimations()
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.EnableAnimationsContext(ctx)
 			},
 		},
 		{
-			Name:  "toggle",
-			Usage: "Toggles between light and dark theme",
+			Name:   "toggle",
+			Usage:  "Toggles between light and dark theme",
+			Before: selectDevice,
 			Action: func(ctx context.Context, c *cli.Command) error {
-				return emulator.ToggleAnimations()
+				d, err := device(ctx)
+				if err != nil {
+					return err
+				}
+				return d.ToggleAnimationsContext(ctx)
 			},
 		},
 	},
 }
 
+var consoleCommand = cli.Command{
+	Name:      "console",
+	Usage:     "Send commands to the emulator console",
+	ArgsUsage: "<avd> [command...]",
+	Category:  categoryControl,
+	Description: "Runs the command, e.g. 'geo fix -122.08 37.42', and prints its output.\n" +
+		"Without a command, reads commands from standard input until EOF or 'quit'.\n\n" +
+		"If several instances of the AVD are running, choose the one to connect to with\n" +
+		"--pid or --serial.",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "pid",
+			Usage: "connect to the instance with given PID",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		avdName := c.Args().First()
+		if avdName == "" {
+			return fmt.Errorf("avd not specified")
+		}
+
+		avd, err := findAVD(ctx, avdName)
+		if err != nil {
+			return err
+		}
+
+		instance, err := selectInstance(avd, int(c.Int("pid")), c.String("serial"))
+		if err != nil {
+			return err
+		}
+
+		conn, err := instance.Console(ctx)
+		if err != nil {
+			return fmt.Errorf("connect to console of avd %s: %w", avdName, err)
+		}
+		defer conn.Close()
+
+		if c.NArg() > 1 {
+			out, err := conn.Command(ctx, strings.Join(c.Args().Tail(), " "))
+			if out != "" {
+				fmt.Println(out)
+			}
+			return err
+		}
+
+		fmt.Print("> ")
+		for {
+			line, err := readLine(ctx)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			cmd := strings.TrimSpace(line)
+			if cmd == "quit" || cmd == "exit" {
+				return nil
+			}
+
+			if cmd != "" {
+				out, err := conn.Command(ctx, cmd)
+				if out != "" {
+					fmt.Println(out)
+				}
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+			fmt.Print("> ")
+		}
+	},
+	ShellComplete: func(ctx context.Context, c *cli.Command) {
+		if c.NArg() > 0 {
+			return
+		}
+
+		avds, err := emulator.ListContext(ctx)
+		if err != nil {
+			return
+		}
+
+		for _, avd := range avds {
+			if avd.Running {
+				fmt.Println(avd.Name)
+			}
+		}
+	},
+}
+
 var systemImagesCommand = cli.Command{
 	Name:     "system-images",
 	Usage:    "Print available Android OS images",
 	Category: categoryUtilities,
 	Action: func(ctx context.Context, c *cli.Command) error {
-		systemImages, err := emulator.SystemImages()
+		systemImages, err := emulator.SystemImagesContext(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to list system images: %w", err)
 		}
@@ -470,6 +1523,63 @@ var systemImagesCommand = cli.Command{
 	},
 }
 
+var doctorCommand = cli.Command{
+	Name:     "doctor",
+	Usage:    "Diagnose the Android SDK, emulator, and AVDs",
+	Category: categoryUtilities,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the report as JSON",
+		},
+	},
+	Action: func(ctx context.Context, c *cli.Command) error {
+		checks := emulator.Diagnose(ctx)
+
+		failed := 0
+		for _, check := range checks {
+			if check.Status == emulator.CheckFailed {
+				failed++
+			}
+		}
+
+		if c.Bool("json") {
+			report := struct {
+				OK     bool             `json:"ok"`
+				Checks []emulator.Check `json:"checks"`
+			}{OK: failed == 0, Checks: checks}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err := enc.Encode(report)
+			if err != nil {
+				return fmt.Errorf("encode report: %w", err)
+			}
+		} else {
+			for _, check := range checks {
+				mark := "✓"
+				switch check.Status {
+				case emulator.CheckWarning:
+					mark = "!"
+				case emulator.CheckFailed:
+					mark = "✗"
+				}
+
+				fmt.Printf("[%s] %s: %s\n", mark, check.Name, check.Message)
+				if check.Fix != "" {
+					fmt.Printf("    fix: %s\n", check.Fix)
+				}
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d checks failed", failed)
+		}
+
+		return nil
+	},
+}
+
 var printDocsCommand = cli.Command{
 	Name:     "docs",
 	Usage:    "Print documentation in various formats",
@@ -488,19 +1598,19 @@ var printDocsCommand = cli.Command{
 		case "", "markdown":
 			content, err := docs.ToMarkdown(cmd.Root())
 			if err != nil {
-				return fmt.Errorf("generate documentation in markdown: %v", err)
+				return fmt.Errorf("generate documentation in markdown: %w", err)
 			}
 			fmt.Println(content)
 		case "man":
 			content, err := docs.ToMan(cmd.Root())
 			if err != nil {
-				return fmt.Errorf("generate documentation in man: %v", err)
+				return fmt.Errorf("generate documentation in man: %w", err)
 			}
 			fmt.Println(content)
 		case "man-with-section":
 			content, err := docs.ToManWithSection(cmd.Root(), 1)
 			if err != nil {
-				return fmt.Errorf("generate documentation in man with section 1: %v", err)
+				return fmt.Errorf("generate documentation in man with section 1: %w", err)
 			}
 			fmt.Println(content)
 		default:
@@ -509,3 +1619,198 @@ var printDocsCommand = cli.Command{
 		return nil
 	},
 }
+
+// prefixWriter writes lines to w, each starting with prefix.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+
+	// midLine is true if the last write didn't end with a newline.
+	midLine bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	var buf []byte
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !p.midLine {
+			buf = append(buf, p.prefix...)
+		}
+		buf = append(buf, line...)
+		p.midLine = line[len(line)-1] != '\n'
+	}
+
+	_, err := p.w.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// installSystemImage offers to install the system image for api, which
+// isn't installed, and returns it. notFound is the error returned when the
+// image couldn't be found.
+func installSystemImage(ctx context.Context, c *cli.Command, api string, notFound error) (emulator.SystemImage, error) {
+	tag := c.String("tag")
+	if tag == "" {
+		tag = "google_apis"
+	}
+	abi := c.String("abi")
+	if abi == "" {
+		abi = emulator.HostABI()
+	}
+	image := emulator.SystemImage(fmt.Sprintf("system-images;android-%s;%s;%s", api, tag, abi))
+
+	if !c.Bool("install") {
+		stat, err := os.Stdin.Stat()
+		if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+			return "", fmt.Errorf("%w, use --install to install %s", notFound, image)
+		}
+
+		ok, err := confirm(ctx, fmt.Sprintf("%v. Install %s with sdkmanager?", notFound, image))
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", notFound
+		}
+	}
+
+	err := emulator.InstallSystemImage(ctx, image)
+	if err != nil {
+		return "", fmt.Errorf("install %s: %w", image, err)
+	}
+
+	return image, nil
+}
+
+// stdinLines returns lines read from standard input in the background. When
+// standard input is closed, the channel is closed and stdinErr is set.
+var stdinLines = sync.OnceValue(func() <-chan string {
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		stdinErr = scanner.Err()
+		close(lines)
+	}()
+
+	return lines
+})
+
+var stdinErr error
+
+// readLine reads a line from standard input. Unlike reading standard input
+// directly, it returns when ctx is done, e.g. after Ctrl-C. At the end of
+// input, the error is io.EOF.
+func readLine(ctx context.Context) (string, error) {
+	select {
+	case line, ok := <-stdinLines():
+		if !ok {
+			if stdinErr != nil {
+				return "", fmt.Errorf("read stdin: %w", stdinErr)
+			}
+			return "", io.EOF
+		}
+		return line, nil
+	case <-ctx.Done():
+		fmt.Println()
+		return "", ctx.Err()
+	}
+}
+
+// confirm asks question and reports whether it was answered with yes.
+func confirm(ctx context.Context, question string) (bool, error) {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := readLine(ctx)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// formatBytes formats n bytes for humans, e.g. "1.5 GB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// findAVD returns the AVD with name.
+func findAVD(ctx context.Context, name string) (emulator.AVD, error) {
+	avds, err := emulator.ListContext(ctx)
+	if err != nil {
+		return emulator.AVD{}, fmt.Errorf("failed to list avds: %w", err)
+	}
+
+	for _, avd := range avds {
+		if avd.Name == name {
+			return avd, nil
+		}
+	}
+
+	return emulator.AVD{}, fmt.Errorf("%w: %s", emulator.ErrNotFound, name)
+}
+
+// selectInstance returns the running instance of avd with pid or serial. If
+// both are empty, avd must have exactly one instance running.
+func selectInstance(avd emulator.AVD, pid int, serial string) (emulator.Instance, error) {
+	if !avd.Running {
+		return emulator.Instance{}, fmt.Errorf("%w: %s", emulator.ErrNotRunning, avd.Name)
+	}
+
+	if pid == 0 && serial == "" {
+		if len(avd.Instances) > 1 {
+			return emulator.Instance{}, fmt.Errorf("%d instances of avd %s are running, choose one with --pid or --serial", len(avd.Instances), avd.Name)
+		}
+
+		return avd.Instances[0], nil
+	}
+
+	for _, instance := range avd.Instances {
+		if (pid == 0 || instance.Pid == pid) && (serial == "" || instance.Serial == serial) {
+			return instance, nil
+		}
+	}
+
+	return emulator.Instance{}, fmt.Errorf("%w: no instance of avd %s matches", emulator.ErrNotRunning, avd.Name)
+}
+
+type deviceKey struct{}
+
+// selectDevice resolves the device that control commands are sent to and
+// stores it in the context.
+func selectDevice(ctx context.Context, c *cli.Command) (context.Context, error) {
+	device, err := emulator.SelectDeviceContext(ctx, c.String("serial"), c.String("avd"))
+	if err != nil {
+		return ctx, fmt.Errorf("select device: %w", err)
+	}
+
+	return context.WithValue(ctx, deviceKey{}, device), nil
+}
+
+// device returns the device stored in the context by selectDevice.
+func device(ctx context.Context) (emulator.Device, error) {
+	device, ok := ctx.Value(deviceKey{}).(emulator.Device)
+	if !ok {
+		return emulator.Device{}, fmt.Errorf("no device selected")
+	}
+
+	return device, nil
+}
@@ -0,0 +1,144 @@
+package emulator
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bartekpacia/emu/ini"
+)
+
+// ConfigType is the type of values of a config.ini key.
+type ConfigType int
+
+const (
+	ConfigString ConfigType = iota
+
+	// ConfigBool values are "yes" or "no".
+	ConfigBool
+
+	// ConfigInt values are positive integers.
+	ConfigInt
+
+	// ConfigSize values are sizes with a K, M, or G unit suffix, e.g. "512M"
+	// or "4G". The value is kept as is. Without a suffix, the unit depends on
+	// the key, e.g. megabytes for hw.ramSize, but bytes for
+	// disk.dataPartition.size.
+	ConfigSize
+)
+
+// ConfigKey is a key of config.ini that this package knows about.
+type ConfigKey struct {
+	Name        string
+	Description string
+	Type        ConfigType
+
+	// Values are the allowed values. Any value of Type is allowed if empty.
+	Values []string
+}
+
+// ConfigKeys are config.ini keys whose values are validated. Other keys can
+// be set to any value.
+var ConfigKeys = []ConfigKey{
+	{Name: "hw.ramSize", Description: "RAM size, e.g. 4G", Type: ConfigSize},
+	{Name: "vm.heapSize", Description: "maximum heap size of an app, e.g. 512M", Type: ConfigSize},
+	{Name: "hw.cpu.ncore", Description: "number of CPU cores", Type: ConfigInt},
+	{Name: "hw.gpu.enabled", Description: "whether the GPU is emulated", Type: ConfigBool},
+	{Name: "hw.gpu.mode", Description: "GPU emulation mode", Type: ConfigString, Values: []string{"auto", "host", "swiftshader_indirect", "angle_indirect", "guest"}},
+	{Name: "hw.keyboard", Description: "whether the host keyboard can be used", Type: ConfigBool},
+	{Name: "hw.mainKeys", Description: "whether the device has hardware back and home keys", Type: ConfigBool},
+	{Name: "hw.lcd.density", Description: "screen density in dpi", Type: ConfigInt},
+	{Name: "hw.lcd.width", Description: "screen width in pixels", Type: ConfigInt},
+	{Name: "hw.lcd.height", Description: "screen height in pixels", Type: ConfigInt},
+	{Name: "hw.camera.back", Description: "source of the back camera", Type: ConfigString, Values: []string{"emulated", "virtualscene", "webcam0", "none"}},
+	{Name: "hw.camera.front", Description: "source of the front camera", Type: ConfigString, Values: []string{"emulated", "webcam0", "none"}},
+	{Name: "disk.dataPartition.size", Description: "size of the data partition, e.g. 6G", Type: ConfigSize},
+	{Name: "sdcard.size", Description: "size of the SD card, e.g. 512M", Type: ConfigSize},
+	{Name: "fastboot.forceColdBoot", Description: "whether to always cold boot", Type: ConfigBool},
+	{Name: "showDeviceFrame", Description: "whether to show the device frame around the screen", Type: ConfigBool},
+}
+
+var sizeRegexp = regexp.MustCompile(`^[0-9]+[KMG]?$`)
+
+// ValidateConfig checks whether value is valid for the config.ini key.
+func ValidateConfig(key, value string) error {
+	if key == "" || strings.ContainsAny(key, "=\n") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	if strings.Contains(value, "\n") {
+		return fmt.Errorf("invalid value %q for %s, must be a single line", value, key)
+	}
+
+	i := slices.IndexFunc(ConfigKeys, func(k ConfigKey) bool { return k.Name == key })
+	if i == -1 {
+		return nil
+	}
+	k := ConfigKeys[i]
+
+	switch k.Type {
+	case ConfigBool:
+		if value != "yes" && value != "no" {
+			return fmt.Errorf("invalid value %q for %s, must be yes or no", value, key)
+		}
+	case ConfigInt:
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid value %q for %s, must be a positive integer", value, key)
+		}
+	case ConfigSize:
+		if !sizeRegexp.MatchString(value) {
+			return fmt.Errorf("invalid value %q for %s, must be a size like 512M or 4G", value, key)
+		}
+	}
+
+	if len(k.Values) > 0 && !slices.Contains(k.Values, value) {
+		return fmt.Errorf("invalid value %q for %s, must be one of %s", value, key, strings.Join(k.Values, ", "))
+	}
+
+	return nil
+}
+
+// ConfigPath returns the path of the AVD's config.ini.
+func (a AVD) ConfigPath() string {
+	return filepath.Join(a.Path, "config.ini")
+}
+
+// Config reads the AVD's config.ini.
+func (a AVD) Config() (*ini.File, error) {
+	return ini.Load(a.ConfigPath())
+}
+
+// SetConfig sets key to value in the AVD's config.ini. It fails with
+// ErrAlreadyRunning if the AVD is running, because the emulator would
+// overwrite the change when it exits.
+func (a AVD) SetConfig(key, value string) error {
+	err := ValidateConfig(key, value)
+	if err != nil {
+		return err
+	}
+
+	return a.editConfig(func(config *ini.File) { config.Set(key, value) })
+}
+
+// UnsetConfig removes key from the AVD's config.ini, so that the emulator
+// uses its default. Like SetConfig, it fails if the AVD is running.
+func (a AVD) UnsetConfig(key string) error {
+	return a.editConfig(func(config *ini.File) { config.Delete(key) })
+}
+
+func (a AVD) editConfig(edit func(config *ini.File)) error {
+	if a.Running {
+		return fmt.Errorf("%w: %s, stop it to change its config", ErrAlreadyRunning, a.Name)
+	}
+
+	config, err := a.Config()
+	if err != nil {
+		return err
+	}
+
+	edit(config)
+	return config.Save(a.ConfigPath())
+}
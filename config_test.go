@@ -0,0 +1,71 @@
+package emulator
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{key: "hw.ramSize", value: "4G"},
+		{key: "hw.ramSize", value: "2048"},
+		{key: "hw.ramSize", value: "lots", wantErr: true},
+		{key: "hw.keyboard", value: "yes"},
+		{key: "hw.keyboard", value: "true", wantErr: true},
+		{key: "hw.cpu.ncore", value: "4"},
+		{key: "hw.cpu.ncore", value: "0", wantErr: true},
+		{key: "hw.gpu.mode", value: "swiftshader_indirect"},
+		{key: "hw.gpu.mode", value: "fast", wantErr: true},
+		{key: "some.unknown.key", value: "anything"},
+		{key: "bad=key", value: "yes", wantErr: true},
+		{key: "hw.initialOrientation", value: "two\nlines", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := ValidateConfig(tt.key, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateConfig(%q, %q) error = %v, want error: %v", tt.key, tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	avd := AVD{Name: "Pixel_7_API_34", Path: t.TempDir()}
+	err := os.WriteFile(avd.ConfigPath(), []byte("# Pixel 7\nhw.keyboard=no\nhw.ramSize=2048\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = avd.SetConfig("hw.keyboard", "yes")
+	if err != nil {
+		t.Fatalf("SetConfig() error: %v", err)
+	}
+	err = avd.SetConfig("hw.cpu.ncore", "many")
+	if err == nil {
+		t.Errorf("SetConfig() with invalid value: error = nil, want error")
+	}
+	err = avd.UnsetConfig("hw.ramSize")
+	if err != nil {
+		t.Fatalf("UnsetConfig() error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(avd.Path, "config.ini"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# Pixel 7\nhw.keyboard=yes\n"; string(data) != want {
+		t.Errorf("config.ini = %q, want %q", data, want)
+	}
+
+	avd.Running = true
+	err = avd.SetConfig("hw.keyboard", "no")
+	if !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("SetConfig() of running AVD error = %v, want %v", err, ErrAlreadyRunning)
+	}
+}
@@ -0,0 +1,186 @@
+// Package console implements a client for the emulator console, which is a
+// telnet-like text protocol served by every running emulator on its console
+// port, e.g. 5554.
+//
+// See https://developer.android.com/studio/run/emulator-console for the
+// list of commands.
+package console
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Error is returned when the emulator replies to a command with KO.
+type Error struct {
+	// Message is the reason of failure sent by the emulator, e.g. "unknown
+	// command, try 'help'".
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "console: " + e.Message
+}
+
+// Dialer connects to emulator consoles.
+type Dialer struct {
+	// Host the console listens on. Defaults to 127.0.0.1.
+	Host string
+
+	// TokenPath is the path of the file with the authentication token.
+	// Defaults to ~/.emulator_console_auth_token.
+	TokenPath string
+}
+
+// Dial connects to the console on port with the default Dialer.
+func Dial(ctx context.Context, port int) (*Conn, error) {
+	return Dialer{}.Dial(ctx, port)
+}
+
+// Dial connects to the console on port and authenticates if the console
+// requires it.
+func (d Dialer) Dial(ctx context.Context, port int) (*Conn, error) {
+	host := d.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("connect to console: %w", err)
+	}
+
+	c := &Conn{conn: netConn, r: bufio.NewReader(netConn)}
+
+	stop := context.AfterFunc(ctx, func() { netConn.Close() })
+	defer stop()
+
+	// Sample banner:
+	// Android Console: Authentication required
+	// Android Console: type 'auth <auth_token>' to authenticate
+	// Android Console: you can find your <auth_token> in
+	// '/Users/bartek/.emulator_console_auth_token'
+	// OK
+	banner, err := c.readReply(ctx)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("read banner: %w", err)
+	}
+
+	if strings.Contains(banner, "Authentication required") {
+		token, err := d.token()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		_, err = c.Command(ctx, "auth "+token)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("authenticate: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (d Dialer) token() (string, error) {
+	path := d.TokenPath
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("get user home directory: %w", err)
+		}
+		path = filepath.Join(home, ".emulator_console_auth_token")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read auth token: %w", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Conn is a connection to an emulator console. It's safe for concurrent use
+// by multiple goroutines, but commands are sent one at a time.
+type Conn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Command sends cmd, e.g. "geo fix -122.08 37.42", and returns its output,
+// without the trailing OK. If the emulator replies with KO, the error is
+// *Error.
+//
+// If ctx is done before the reply is read, the connection is closed.
+func (c *Conn) Command(ctx context.Context, cmd string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	defer stop()
+
+	_, err := fmt.Fprintf(c.conn, "%s\r\n", cmd)
+	if err != nil {
+		return "", fmt.Errorf("send command: %w", ctxErr(ctx, err))
+	}
+
+	return c.readReply(ctx)
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// readReply reads lines until OK or KO.
+func (c *Conn) readReply(ctx context.Context) (string, error) {
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if err == io.EOF && line == "" {
+			return "", fmt.Errorf("console closed the connection: %w", ctxErr(ctx, io.ErrUnexpectedEOF))
+		}
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("read reply: %w", ctxErr(ctx, err))
+		}
+
+		switch {
+		case line == "OK":
+			return strings.Join(lines, "\n"), nil
+		case strings.HasPrefix(line, "OK:"):
+			// E.g. "OK: killing emulator, bye bye"
+			lines = append(lines, strings.TrimSpace(strings.TrimPrefix(line, "OK:")))
+			return strings.Join(lines, "\n"), nil
+		case strings.HasPrefix(line, "KO:"):
+			return strings.Join(lines, "\n"), &Error{Message: strings.TrimSpace(strings.TrimPrefix(line, "KO:"))}
+		}
+
+		lines = append(lines, line)
+		if err == io.EOF {
+			return "", fmt.Errorf("console closed the connection: %w", io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// ctxErr returns the error of ctx if it's done, since then err is only a
+// consequence of closing the connection.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
@@ -0,0 +1,117 @@
+package console
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeConsole serves a single console connection that requires token and
+// replies to commands with replies.
+func fakeConsole(t *testing.T, token string, replies map[string]string) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(conn, "Android Console: Authentication required\r\n"+
+			"Android Console: type 'auth <auth_token>' to authenticate\r\n"+
+			"Android Console: you can find your <auth_token> in\r\n"+
+			"'/home/bartek/.emulator_console_auth_token'\r\n"+
+			"OK\r\n")
+
+		authenticated := false
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			cmd := strings.TrimSpace(scanner.Text())
+			switch {
+			case cmd == "auth "+token:
+				authenticated = true
+				fmt.Fprint(conn, "Android Console: type 'help' for a list of commands\r\nOK\r\n")
+			case strings.HasPrefix(cmd, "auth "):
+				fmt.Fprint(conn, "KO: authentication token does not match ~/.emulator_console_auth_token\r\n")
+			case !authenticated:
+				fmt.Fprint(conn, "KO: unknown command, try 'help'\r\n")
+			case replies[cmd] != "":
+				fmt.Fprint(conn, replies[cmd])
+			default:
+				fmt.Fprint(conn, "KO: unknown command, try 'help'\r\n")
+			}
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func writeToken(t *testing.T, token string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), ".emulator_console_auth_token")
+	err := os.WriteFile(path, []byte(token), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestCommand(t *testing.T) {
+	port := fakeConsole(t, "s3cr3t", map[string]string{
+		"avd name":     "Pixel_7_API_34\r\nOK\r\n",
+		"geo fix 1 2":  "OK\r\n",
+		"power status": "KO: bad sub-command\r\n",
+	})
+	dialer := Dialer{TokenPath: writeToken(t, "s3cr3t\n")}
+
+	conn, err := dialer.Dial(context.Background(), port)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+
+	out, err := conn.Command(context.Background(), "avd name")
+	if err != nil {
+		t.Fatalf("Command() error: %v", err)
+	}
+	if out != "Pixel_7_API_34" {
+		t.Errorf("Command() = %q, want %q", out, "Pixel_7_API_34")
+	}
+
+	out, err = conn.Command(context.Background(), "geo fix 1 2")
+	if err != nil || out != "" {
+		t.Errorf("Command() = %q, %v, want empty output", out, err)
+	}
+
+	_, err = conn.Command(context.Background(), "power status")
+	var consoleErr *Error
+	if !errors.As(err, &consoleErr) || consoleErr.Message != "bad sub-command" {
+		t.Errorf("Command() error = %v, want KO: bad sub-command", err)
+	}
+}
+
+func TestDialWrongToken(t *testing.T) {
+	port := fakeConsole(t, "s3cr3t", nil)
+	dialer := Dialer{TokenPath: writeToken(t, "wrong")}
+
+	_, err := dialer.Dial(context.Background(), port)
+	var consoleErr *Error
+	if !errors.As(err, &consoleErr) {
+		t.Errorf("Dial() error = %v, want *Error", err)
+	}
+}
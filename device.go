@@ -0,0 +1,391 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bartekpacia/emu/adb"
+	"github.com/bartekpacia/emu/console"
+)
+
+// Device is a handle to a device attached to adb, for example, a running AVD.
+//
+// Device only holds the serial of the device, so it's safe for concurrent use
+// by multiple goroutines.
+type Device struct {
+	// Serial of the device, for example, "emulator-5554".
+	Serial string
+}
+
+// ADBClient is used to talk to the adb server. Functions of this package fall
+// back to running the adb executable, which also starts the server, if the
+// server isn't running.
+//
+// It must not be changed while other functions of this package are running.
+var ADBClient = adb.NewClient()
+
+// NewDevice returns a handle to the device with serial.
+func NewDevice(serial string) Device {
+	return Device{Serial: serial}
+}
+
+// Device returns a handle to the device this AVD is running as. If several
+// instances of the AVD are running, one of them is returned.
+func (a AVD) Device() (Device, error) {
+	return a.DeviceContext(context.Background())
+}
+
+// DeviceContext is like Device but uses ctx to run adb.
+func (a AVD) DeviceContext(ctx context.Context) (Device, error) {
+	if !a.Running {
+		return Device{}, fmt.Errorf("%w: %s", ErrNotRunning, a.Name)
+	}
+
+	for _, instance := range a.Instances {
+		if instance.Serial != "" {
+			return NewDevice(instance.Serial), nil
+		}
+	}
+
+	return SelectDeviceContext(ctx, "", a.Name)
+}
+
+// Console connects to the console of the emulator this AVD is running in.
+func (a AVD) Console(ctx context.Context) (*console.Conn, error) {
+	device, err := a.DeviceContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return device.Console(ctx)
+}
+
+// Console connects to the console of this emulator instance.
+func (i Instance) Console(ctx context.Context) (*console.Conn, error) {
+	if i.Port == 0 {
+		if i.Serial == "" {
+			return nil, fmt.Errorf("console port of process %d is unknown", i.Pid)
+		}
+		return NewDevice(i.Serial).Console(ctx)
+	}
+
+	return console.Dial(ctx, i.Port)
+}
+
+// Devices returns serials of devices that are attached to adb and online.
+func Devices() ([]string, error) {
+	return DevicesContext(context.Background())
+}
+
+// DevicesContext is like Devices but uses ctx to run adb.
+func DevicesContext(ctx context.Context) ([]string, error) {
+	devices, err := ADBClient.Devices(ctx)
+	if err == nil {
+		var serials []string
+		for _, device := range devices {
+			if device.State == "device" {
+				serials = append(serials, device.Serial)
+			}
+		}
+
+		return serials, nil
+	}
+	if !errors.Is(err, adb.ErrServerUnavailable) {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+
+	data, err := CommandRunner.Run(ctx, LocateSDK().ADB(), "devices")
+	if err != nil {
+		return nil, fmt.Errorf("failed to run adb devices: %w", err)
+	}
+
+	// Sample output:
+	// List of devices attached
+	// emulator-5554	device
+	// emulator-5556	offline
+	var serials []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[1] != "device" {
+			continue
+		}
+
+		serials = append(serials, fields[0])
+	}
+
+	return serials, nil
+}
+
+// AVDName returns the name of the AVD running as the device with serial.
+func AVDName(serial string) (string, error) {
+	return NewDevice(serial).AVDName()
+}
+
+// AVDNameContext is like AVDName but uses ctx to run adb.
+func AVDNameContext(ctx context.Context, serial string) (string, error) {
+	return NewDevice(serial).AVDNameContext(ctx)
+}
+
+// SelectDevice returns the device that commands should target.
+//
+// If serial is not empty, the device with that serial is returned. If avdName
+// is not empty, the device the AVD with that name is running as is returned.
+// Otherwise, the only attached device is returned, and an error if there are
+// none or more than one.
+func SelectDevice(serial, avdName string) (Device, error) {
+	return SelectDeviceContext(context.Background(), serial, avdName)
+}
+
+// SelectDeviceContext is like SelectDevice but uses ctx to run adb.
+func SelectDeviceContext(ctx context.Context, serial, avdName string) (Device, error) {
+	if serial != "" {
+		return NewDevice(serial), nil
+	}
+
+	serials, err := DevicesContext(ctx)
+	if err != nil {
+		return Device{}, err
+	}
+
+	if avdName != "" {
+		for _, s := range serials {
+			if !strings.HasPrefix(s, "emulator-") {
+				continue
+			}
+
+			name, err := AVDNameContext(ctx, s)
+			if err != nil {
+				continue
+			}
+
+			if name == avdName {
+				return NewDevice(s), nil
+			}
+		}
+
+		return Device{}, fmt.Errorf("%w: %s", ErrNotRunning, avdName)
+	}
+
+	switch len(serials) {
+	case 0:
+		return Device{}, fmt.Errorf("%w: no devices attached", ErrNotRunning)
+	case 1:
+		return NewDevice(serials[0]), nil
+	default:
+		return Device{}, fmt.Errorf("more than one device attached (%s), choose one by serial or AVD name", strings.Join(serials, ", "))
+	}
+}
+
+// ConsolePort returns the console port of the emulator this device is, which
+// is encoded in its serial, e.g. 5554 for "emulator-5554".
+func (d Device) ConsolePort() (int, error) {
+	port, ok := strings.CutPrefix(d.Serial, "emulator-")
+	if !ok {
+		return 0, fmt.Errorf("device %s is not an emulator", d.Serial)
+	}
+
+	return strconv.Atoi(port)
+}
+
+// Console connects to the console of the emulator this device is.
+func (d Device) Console(ctx context.Context) (*console.Conn, error) {
+	port, err := d.ConsolePort()
+	if err != nil {
+		return nil, err
+	}
+
+	return console.Dial(ctx, port)
+}
+
+// AVDName returns the name of the AVD this device is running. It fails if the
+// device isn't an emulator.
+func (d Device) AVDName() (string, error) {
+	return d.AVDNameContext(context.Background())
+}
+
+// AVDNameContext is like AVDName but uses ctx to run adb.
+func (d Device) AVDNameContext(ctx context.Context) (string, error) {
+	data, err := d.adb(ctx, "emu", "avd", "name")
+	if err != nil {
+		return "", fmt.Errorf("failed to run adb emu avd name: %w", err)
+	}
+
+	// Sample output:
+	// Pixel_7_API_34
+	// OK
+	name, _, _ := strings.Cut(string(data), "\n")
+	name = strings.TrimSpace(name)
+	if name == "" || name == "OK" {
+		return "", fmt.Errorf("%w: %q", ErrUnexpectedOutput, data)
+	}
+
+	return name, nil
+}
+
+func (d Device) EnableDarkTheme() error {
+	return d.EnableDarkThemeContext(context.Background())
+}
+
+// EnableDarkThemeContext is like EnableDarkTheme but uses ctx to run adb.
+func (d Device) EnableDarkThemeContext(ctx context.Context) error {
+	return d.shell(ctx, "cmd", "uimode", "night", "yes")
+}
+
+func (d Device) DisableDarkTheme() error {
+	return d.DisableDarkThemeContext(context.Background())
+}
+
+// DisableDarkThemeContext is like DisableDarkTheme but uses ctx to run adb.
+func (d Device) DisableDarkThemeContext(ctx context.Context) error {
+	return d.shell(ctx, "cmd", "uimode", "night", "no")
+}
+
+func (d Device) ToggleDarkTheme() error {
+	return d.ToggleDarkThemeContext(context.Background())
+}
+
+// ToggleDarkThemeContext is like ToggleDarkTheme but uses ctx to run adb.
+func (d Device) ToggleDarkThemeContext(ctx context.Context) error {
+	out, err := d.shellOutput(ctx, "cmd", "uimode", "night")
+	if err != nil {
+		return fmt.Errorf("failed to run and read stdout: %w", err)
+	}
+	output := string(out)
+
+	targetMode := "yes"
+	if output == "Night mode: yes\n" {
+		targetMode = "no"
+	}
+
+	return d.shell(ctx, "cmd", "uimode", "night", targetMode)
+}
+
+func (d Device) SetFontSize(value string) error {
+	return d.SetFontSizeContext(context.Background(), value)
+}
+
+// SetFontSizeContext is like SetFontSize but uses ctx to run adb.
+func (d Device) SetFontSizeContext(ctx context.Context, value string) error {
+	return d.shell(ctx, "settings", "put", "system", "font_scale", value)
+}
+
+func (d Device) SetDisplaySize(value float32) error {
+	return d.SetDisplaySizeContext(context.Background(), value)
+}
+
+// SetDisplaySizeContext is like SetDisplaySize but uses ctx to run adb.
+func (d Device) SetDisplaySizeContext(ctx context.Context, value float32) error {
+	density, err := d.density(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get density: %w", err)
+	}
+
+	return d.shell(ctx, "wm", "density", fmt.Sprintf("%d", int(float32(density)*value)))
+}
+
+func (d Device) DisableAnimations() error {
+	return d.DisableAnimationsContext(context.Background())
+}
+
+// DisableAnimationsContext is like DisableAnimations but uses ctx to run adb.
+func (d Device) DisableAnimationsContext(ctx context.Context) error {
+	return d.setAnimationScale(ctx, "0")
+}
+
+func (d Device) EnableAnimations() error {
+	return d.EnableAnimationsContext(context.Background())
+}
+
+// EnableAnimationsContext is like EnableAnimations but uses ctx to run adb.
+func (d Device) EnableAnimationsContext(ctx context.Context) error {
+	return d.setAnimationScale(ctx, "1")
+}
+
+func (d Device) ToggleAnimations() error {
+	return d.ToggleAnimationsContext(context.Background())
+}
+
+// ToggleAnimationsContext is like ToggleAnimations but uses ctx to run adb.
+func (d Device) ToggleAnimationsContext(ctx context.Context) error {
+	// the 3 values are always in sync, so I think it's enough to get just a single one
+	out, err := d.shellOutput(ctx, "settings", "get", "global", "window_animation_scale")
+	if err != nil {
+		return fmt.Errorf("failed to run and read stdout: %w", err)
+	}
+	output := string(out)
+
+	// basic validation
+	if output != "0\n" && output != "1\n" {
+		return fmt.Errorf("%w: %q", ErrUnexpectedOutput, output)
+	}
+
+	targetScale := "1"
+	if output == "1\n" {
+		targetScale = "0"
+	}
+
+	return d.setAnimationScale(ctx, targetScale)
+}
+
+func (d Device) setAnimationScale(ctx context.Context, scale string) error {
+	var err error
+	err = d.shell(ctx, "settings", "put", "global", "window_animation_scale", scale)
+	if err != nil {
+		return err
+	}
+	err = d.shell(ctx, "settings", "put", "global", "transition_animation_scale", scale)
+	if err != nil {
+		return err
+	}
+	err = d.shell(ctx, "settings", "put", "global", "animator_duration_scale", scale)
+	return err
+}
+
+func (d Device) density(ctx context.Context) (int, error) {
+	out, err := d.shellOutput(ctx, "wm", "density")
+	if err != nil {
+		return 0, fmt.Errorf("failed to run: %w", err)
+	}
+	output := string(out)
+
+	var density int
+	_, err = fmt.Sscanf(output, "Physical density: %d", &density)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse density: %w: %v", ErrUnexpectedOutput, err)
+	}
+
+	return density, nil
+}
+
+func (d Device) shell(ctx context.Context, cmd ...string) error {
+	_, err := d.shellOutput(ctx, cmd...)
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %w", cmd, err)
+	}
+	return nil
+}
+
+// shellOutput runs cmd in the shell of this device and returns its output.
+//
+// It talks to the adb server directly, and falls back to the adb executable
+// if the server isn't running.
+func (d Device) shellOutput(ctx context.Context, cmd ...string) ([]byte, error) {
+	out, err := ADBClient.Shell(ctx, d.Serial, cmd...)
+	if errors.Is(err, adb.ErrServerUnavailable) {
+		return d.adb(ctx, append([]string{"shell"}, cmd...)...)
+	}
+
+	return out, err
+}
+
+// adb runs adb with args against this device and returns its output.
+func (d Device) adb(ctx context.Context, args ...string) ([]byte, error) {
+	if d.Serial != "" {
+		args = append([]string{"-s", d.Serial}, args...)
+	}
+
+	return CommandRunner.Run(ctx, LocateSDK().ADB(), args...)
+}
@@ -0,0 +1,53 @@
+package emulator
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestToggleDarkTheme(t *testing.T) {
+	tests := []struct {
+		current string
+		want    string
+	}{
+		{current: "Night mode: yes\n", want: "adb -s emulator-5554 shell cmd uimode night no"},
+		{current: "Night mode: no\n", want: "adb -s emulator-5554 shell cmd uimode night yes"},
+	}
+
+	for _, tt := range tests {
+		runner := useFakeRunner(t, map[string]string{
+			"adb -s emulator-5554 shell cmd uimode night": tt.current,
+		})
+
+		err := NewDevice("emulator-5554").ToggleDarkTheme()
+		if err != nil {
+			t.Fatalf("ToggleDarkTheme() error: %v", err)
+		}
+
+		want := []string{"adb -s emulator-5554 shell cmd uimode night", tt.want}
+		if calls := runner.Calls(); !slices.Equal(calls, want) {
+			t.Errorf("invocations = %q, want %q", calls, want)
+		}
+	}
+}
+
+func TestSelectDevice(t *testing.T) {
+	useFakeRunner(t, map[string]string{
+		"adb devices":                       "List of devices attached\nemulator-5554\tdevice\nemulator-5556\tdevice\n\n",
+		"adb -s emulator-5554 emu avd name": "Pixel_7_API_34\r\nOK\r\n",
+		"adb -s emulator-5556 emu avd name": "Pixel_9_API_35\r\nOK\r\n",
+	})
+
+	device, err := SelectDevice("", "Pixel_9_API_35")
+	if err != nil {
+		t.Fatalf("SelectDevice() error: %v", err)
+	}
+	if device.Serial != "emulator-5556" {
+		t.Errorf("SelectDevice() serial = %q, want %q", device.Serial, "emulator-5556")
+	}
+
+	_, err = SelectDevice("", "")
+	if err == nil {
+		t.Errorf("SelectDevice() with two devices attached: error = nil, want error")
+	}
+}
@@ -0,0 +1,189 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bartekpacia/emu/ini"
+)
+
+// readAVDs returns AVDs defined by <name>.ini files in avdHome, sorted by
+// name. It returns no AVDs if avdHome doesn't exist.
+func readAVDs(avdHome string) ([]AVD, error) {
+	entries, err := os.ReadDir(avdHome)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read directory %s: %w", avdHome, err)
+	}
+
+	var avds []AVD
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".ini")
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		iniPath := filepath.Join(avdHome, entry.Name())
+		values, err := ini.Load(iniPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sample <name>.ini:
+		// avd.ini.encoding=UTF-8
+		// path=/Users/bartek/.android/avd/Pixel_7_API_34.avd
+		// path.rel=avd/Pixel_7_API_34.avd
+		// target=android-34
+		path := values.Value("path")
+		if path == "" {
+			path = filepath.Join(avdHome, name+".avd")
+		}
+
+		avds = append(avds, AVD{Name: name, Path: path, Target: values.Value("target")})
+	}
+
+	return avds, nil
+}
+
+// resolvePorts sets the console port and serial of running instances of avds
+// that weren't started with -port.
+//
+// Ports are read from discovery files the emulator writes while it runs, and
+// if there are none, matched by asking emulators attached to adb for the name
+// of their AVD.
+func resolvePorts(ctx context.Context, avds []AVD) {
+	ports := readDiscoveryFiles(discoveryDir())
+
+	resolved := true
+	var known []int
+	for _, avd := range avds {
+		for i, instance := range avd.Instances {
+			if instance.Port == 0 {
+				avd.Instances[i].setPort(ports[instance.Pid])
+			}
+
+			if avd.Instances[i].Port == 0 {
+				resolved = false
+			} else {
+				known = append(known, avd.Instances[i].Port)
+			}
+		}
+	}
+	if resolved {
+		return
+	}
+
+	// The adb server is queried directly, because running adb would start
+	// it if it isn't running.
+	devices, err := ADBClient.Devices(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, device := range devices {
+		if device.State != "device" {
+			continue
+		}
+
+		serial := device.Serial
+		port, err := NewDevice(serial).ConsolePort()
+		if err != nil || slices.Contains(known, port) {
+			continue
+		}
+
+		name, err := AVDNameContext(ctx, serial)
+		if err != nil {
+			continue
+		}
+
+		// The port can be matched only if a single instance of the AVD has an
+		// unknown port.
+		for _, avd := range avds {
+			if avd.Name != name {
+				continue
+			}
+
+			var unknown []int
+			for i, instance := range avd.Instances {
+				if instance.Port == 0 {
+					unknown = append(unknown, i)
+				}
+			}
+			if len(unknown) == 1 {
+				avd.Instances[unknown[0]].setPort(port)
+			}
+		}
+	}
+}
+
+func (i *Instance) setPort(port int) {
+	if port == 0 {
+		return
+	}
+
+	i.Port = port
+	i.Serial = fmt.Sprintf("emulator-%d", port)
+}
+
+// discoveryDir returns the directory the emulator writes discovery files of
+// running emulators to.
+func discoveryDir() string {
+	switch runtime.GOOS {
+	case "linux":
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+			return filepath.Join(dir, "avd", "running")
+		}
+	case "darwin":
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, "Library", "Caches", "TemporaryItems", "avd", "running")
+		}
+	case "windows":
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "Temp", "avd", "running")
+		}
+	}
+
+	return filepath.Join(LocateSDK().UserHome, "avd", "running")
+}
+
+// readDiscoveryFiles returns console ports of running emulators keyed by PID,
+// read from pid_<pid>.ini files in dir.
+func readDiscoveryFiles(dir string) map[int]int {
+	paths, _ := filepath.Glob(filepath.Join(dir, "pid_*.ini"))
+
+	ports := make(map[int]int)
+	for _, path := range paths {
+		pid, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "pid_"), ".ini"))
+		if err != nil {
+			continue
+		}
+
+		// Sample pid_1234.ini:
+		// port.serial=5554
+		// port.adb=5555
+		// avd.name=Pixel_7_API_34
+		// avd.dir=/Users/bartek/.android/avd/Pixel_7_API_34.avd
+		// grpc.port=8554
+		values, err := ini.Load(path)
+		if err != nil {
+			continue
+		}
+
+		port, err := strconv.Atoi(values.Value("port.serial"))
+		if err == nil {
+			ports[pid] = port
+		}
+	}
+
+	return ports
+}
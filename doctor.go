@@ -0,0 +1,272 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// CheckStatus is the outcome of a Check.
+type CheckStatus string
+
+const (
+	CheckOK      CheckStatus = "ok"
+	CheckWarning CheckStatus = "warning"
+	CheckFailed  CheckStatus = "failed"
+)
+
+// Check is the result of diagnosing a single aspect of the local emulator
+// environment.
+type Check struct {
+	Name    string      `json:"name"`
+	Status  CheckStatus `json:"status"`
+	Message string      `json:"message"`
+
+	// Fix describes how to fix the problem. Empty if Status is CheckOK.
+	Fix string `json:"fix,omitempty"`
+}
+
+// Diagnose checks whether the Android SDK, its tools, hardware acceleration,
+// and AVDs are set up correctly.
+func Diagnose(ctx context.Context) []Check {
+	sdk := LocateSDK()
+
+	checks := []Check{
+		checkSDKRoot(sdk),
+		checkAVDHome(sdk),
+		checkTool(ctx, "emulator", sdk.Emulator(), "emulator", "-version"),
+		checkTool(ctx, "adb", sdk.ADB(), "platform-tools", "version"),
+		checkTool(ctx, "cmdline-tools", sdk.SDKManager(), "cmdline-tools;latest", "--version"),
+		checkKVM(),
+		checkADBServer(ctx),
+	}
+	checks = append(checks, checkSystemImages(sdk)...)
+	checks = append(checks, checkAVDImages(sdk)...)
+
+	return checks
+}
+
+func checkSDKRoot(sdk SDK) Check {
+	check := Check{Name: "sdk"}
+	if sdk.Root == "" {
+		check.Status = CheckFailed
+		check.Message = "Android SDK not found"
+		check.Fix = "install the Android SDK and set ANDROID_HOME to its location"
+		return check
+	}
+
+	if !isDir(sdk.Root) {
+		check.Status = CheckFailed
+		check.Message = fmt.Sprintf("Android SDK directory %s doesn't exist", sdk.Root)
+		check.Fix = "set ANDROID_HOME to the location of the Android SDK"
+		return check
+	}
+
+	check.Status = CheckOK
+	check.Message = fmt.Sprintf("Android SDK found at %s", sdk.Root)
+	return check
+}
+
+func checkAVDHome(sdk SDK) Check {
+	check := Check{Name: "avd-home"}
+	if sdk.AVDHome == "" {
+		check.Status = CheckFailed
+		check.Message = "can't determine where AVDs are stored"
+		check.Fix = "set ANDROID_AVD_HOME or ANDROID_USER_HOME"
+		return check
+	}
+
+	if !isDir(sdk.AVDHome) {
+		check.Status = CheckWarning
+		check.Message = fmt.Sprintf("AVD directory %s doesn't exist", sdk.AVDHome)
+		check.Fix = "create an AVD with 'emu create'"
+		return check
+	}
+
+	check.Status = CheckOK
+	check.Message = fmt.Sprintf("AVDs are stored in %s", sdk.AVDHome)
+	return check
+}
+
+// checkTool runs the tool at path with versionArgs and reports the first
+// line of its output. pkg is the sdkmanager package the tool is part of.
+func checkTool(ctx context.Context, name, path, pkg string, versionArgs ...string) Check {
+	check := Check{Name: name}
+
+	out, err := CommandRunner.Run(ctx, path, versionArgs...)
+	if err != nil {
+		check.Status = CheckFailed
+		check.Message = fmt.Sprintf("%s: %v", path, err)
+		if errors.Is(err, ErrToolMissing) {
+			check.Message = fmt.Sprintf("%s not found", name)
+		}
+		check.Fix = fmt.Sprintf("run 'sdkmanager \"%s\"' to install it", pkg)
+		return check
+	}
+
+	version := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		// The emulator may print INFO lines before the version.
+		if line != "" && !strings.HasPrefix(line, "INFO") {
+			version = line
+			break
+		}
+	}
+
+	check.Status = CheckOK
+	check.Message = fmt.Sprintf("%s: %s", path, version)
+	return check
+}
+
+func checkKVM() Check {
+	check := Check{Name: "acceleration"}
+	if runtime.GOOS != "linux" {
+		check.Status = CheckOK
+		check.Message = fmt.Sprintf("uses the native hypervisor on %s", runtime.GOOS)
+		return check
+	}
+
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		check.Status = CheckFailed
+		check.Message = "/dev/kvm doesn't exist, so the emulator can't use hardware acceleration"
+		check.Fix = "enable virtualization in BIOS/UEFI and load the kvm_intel or kvm_amd kernel module"
+		return check
+	}
+	if err != nil {
+		check.Status = CheckFailed
+		check.Message = fmt.Sprintf("can't access /dev/kvm: %v", err)
+		check.Fix = "add yourself to the group owning /dev/kvm, e.g. 'sudo usermod -aG kvm $USER', and log in again"
+		return check
+	}
+	f.Close()
+
+	check.Status = CheckOK
+	check.Message = "/dev/kvm is accessible"
+	return check
+}
+
+func checkADBServer(ctx context.Context) Check {
+	check := Check{Name: "adb-server"}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	devices, err := ADBClient.Devices(ctx)
+	if err != nil {
+		check.Status = CheckWarning
+		check.Message = fmt.Sprintf("adb server isn't reachable at %s: %v", ADBClient.Addr, err)
+		check.Fix = "run 'adb start-server'"
+		return check
+	}
+
+	check.Status = CheckOK
+	check.Message = fmt.Sprintf("adb server is reachable at %s, %d devices attached", ADBClient.Addr, len(devices))
+	return check
+}
+
+func checkSystemImages(sdk SDK) []Check {
+	images := installedSystemImages(sdk.Root)
+	if len(images) == 0 {
+		return []Check{{
+			Name:    "system-images",
+			Status:  CheckWarning,
+			Message: "no system images installed",
+			Fix:     fmt.Sprintf("run 'sdkmanager \"system-images;android-35;google_apis;%s\"' to install one", HostABI()),
+		}}
+	}
+
+	var checks []Check
+	for _, image := range images {
+		check := Check{Name: "system-images", Status: CheckOK, Message: fmt.Sprintf("%s matches host ABI", image)}
+		if image.ABI() != HostABI() {
+			check.Status = CheckWarning
+			check.Message = fmt.Sprintf("%s doesn't match host ABI %s, so it will be slow or won't boot", image, HostABI())
+			check.Fix = fmt.Sprintf("use a system image for %s", HostABI())
+		}
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+func checkAVDImages(sdk SDK) []Check {
+	if sdk.AVDHome == "" {
+		return nil
+	}
+
+	avds, err := readAVDs(sdk.AVDHome)
+	if err != nil {
+		return []Check{{Name: "avds", Status: CheckFailed, Message: err.Error()}}
+	}
+
+	var checks []Check
+	for _, avd := range avds {
+		check := Check{Name: "avd " + avd.Name}
+
+		config, err := avd.Config()
+		if err != nil {
+			check.Status = CheckFailed
+			check.Message = err.Error()
+			check.Fix = fmt.Sprintf("delete the AVD with 'emu rm %s' and create it again", avd.Name)
+			checks = append(checks, check)
+			continue
+		}
+
+		// E.g. system-images/android-34/google_apis/x86_64/
+		sysdir := config.Value("image.sysdir.1")
+		if sysdir == "" {
+			check.Status = CheckFailed
+			check.Message = "config.ini doesn't set image.sysdir.1"
+			check.Fix = fmt.Sprintf("delete the AVD with 'emu rm %s' and create it again", avd.Name)
+			checks = append(checks, check)
+			continue
+		}
+
+		if sdk.Root != "" && !isDir(filepath.Join(sdk.Root, sysdir)) {
+			check.Status = CheckFailed
+			check.Message = fmt.Sprintf("system image %s isn't installed", sysdir)
+			check.Fix = fmt.Sprintf("run 'sdkmanager \"%s\"' to install it", strings.ReplaceAll(strings.Trim(sysdir, "/"), "/", ";"))
+			checks = append(checks, check)
+			continue
+		}
+
+		check.Status = CheckOK
+		check.Message = fmt.Sprintf("uses system image %s", sysdir)
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+// installedSystemImages returns system images installed in the SDK at root,
+// found by looking for system-images/<platform>/<tag>/<abi> directories.
+func installedSystemImages(root string) []SystemImage {
+	if root == "" {
+		return nil
+	}
+
+	dirs, _ := filepath.Glob(filepath.Join(root, "system-images", "*", "*", "*"))
+
+	var images []SystemImage
+	for _, dir := range dirs {
+		if !isDir(dir) {
+			continue
+		}
+
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			continue
+		}
+
+		images = append(images, SystemImage(strings.ReplaceAll(filepath.ToSlash(rel), "/", ";")))
+	}
+
+	return images
+}
@@ -0,0 +1,48 @@
+package emulator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckAVDImages(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "system-images", "android-34", "google_apis", "x86_64"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	avdHome := useAVDHome(t, "Installed", "Missing")
+	configs := map[string]string{
+		"Installed": "image.sysdir.1=system-images/android-34/google_apis/x86_64/\n",
+		"Missing":   "image.sysdir.1=system-images/android-35/google_apis/x86_64/\n",
+	}
+	for name, config := range configs {
+		avdDir := filepath.Join(avdHome, name+".avd")
+		err := os.MkdirAll(avdDir, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(avdDir, "config.ini"), []byte(config), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checks := checkAVDImages(SDK{Root: root, AVDHome: avdHome})
+	if len(checks) != 2 {
+		t.Fatalf("checkAVDImages() returned %d checks, want 2", len(checks))
+	}
+
+	if checks[0].Status != CheckOK {
+		t.Errorf("check for AVD with installed image: status = %s, want %s", checks[0].Status, CheckOK)
+	}
+	if checks[1].Status != CheckFailed {
+		t.Errorf("check for AVD with missing image: status = %s, want %s", checks[1].Status, CheckFailed)
+	}
+	wantFix := `run 'sdkmanager "system-images;android-35;google_apis;x86_64"' to install it`
+	if checks[1].Fix != wantFix {
+		t.Errorf("fix = %q, want %q", checks[1].Fix, wantFix)
+	}
+}
@@ -2,291 +2,480 @@
 package emulator
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"os/exec"
+	"io"
+	"net"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // PrintInvocations controls whether to print invocations of subprocesses.
 var PrintInvocations bool
 
-// Serial is the serial port of the running AVD, for example, "emulator-5554".
-var Serial string
-
 // AVD represents an Android Virtual Device.
-//
-// It assumes that no two instances of the same AVD run at the same time.
 type AVD struct {
-	Name    string
+	Name string
+
+	// Path of the AVD's content directory, e.g. ~/.android/avd/Pixel_7_API_34.avd.
+	Path string
+
+	// Target is the Android platform the AVD runs, e.g. "android-34".
+	Target string
+
 	Running bool
 
-	// PID of the emulator process. Equals 0 if Running is false.
+	// Instances of the AVD that are running. Several instances of the same AVD
+	// can run at the same time if all but one are read-only.
+	Instances []Instance
+}
+
+// Instance is a running emulator process of an AVD.
+type Instance struct {
 	Pid int
+
+	// Port is the console port of the emulator, e.g. 5554. Equals 0 if it
+	// can't be determined.
+	Port int
+
+	// Serial is the adb serial of the emulator, e.g. "emulator-5554". Empty
+	// if unknown.
+	Serial string
+
+	// ReadOnly is true if the emulator was started with -read-only, so it
+	// doesn't modify the AVD.
+	ReadOnly bool
+
+	// Args are the command line arguments the emulator was started with, e.g.
+	// ["@Pixel_7_API_34", "-no-window"].
+	Args []string
 }
 
 func (a AVD) Describe() string {
+	var serials []string
+	for _, instance := range a.Instances {
+		if instance.Serial != "" {
+			serials = append(serials, instance.Serial)
+		}
+	}
+
 	suffix := ""
-	if a.Running {
+	if len(a.Instances) > 1 {
+		suffix = fmt.Sprintf(" RUNNING (%d instances", len(a.Instances))
+		if len(serials) > 0 {
+			suffix += ": " + strings.Join(serials, ", ")
+		}
+		suffix += ")"
+	} else if a.Running {
 		suffix = " RUNNING"
+		if len(serials) > 0 {
+			suffix += fmt.Sprintf(" (%s)", serials[0])
+		}
 	}
 
 	return fmt.Sprintf("%s%s", a.Name, suffix)
 }
 
-// List returns a list of available AVDs and whether they're running or not.
-func List() ([]AVD, error) {
-	cmd := exec.Command("emulator", "-list-avds")
-	printInvocation(cmd)
-	data, err := cmd.Output()
-	if err != nil {
-		return nil, err
-	}
+// StartOptions configures how an AVD is started. The zero value starts the
+// AVD with the emulator's defaults, except that the boot animation and audio
+// are disabled.
+type StartOptions struct {
+	// NoWindow starts the emulator without a window (-no-window).
+	NoWindow bool
 
-	avdsStr := strings.Split(string(data), "\n")
-	// remove empty strings
-	for i := len(avdsStr) - 1; i >= 0; i-- {
-		if avdsStr[i] == "" {
-			avdsStr = append(avdsStr[:i], avdsStr[i+1:]...)
-		}
-	}
+	// ColdBoot boots the AVD from scratch instead of loading the quickboot
+	// snapshot (-no-snapshot-load).
+	ColdBoot bool
+
+	// WipeData resets user data of the AVD to its initial state (-wipe-data).
+	WipeData bool
+
+	// Port is the console port of the emulator (-port). adb connects on Port+1.
+	// It must be an even number between 5554 and 5682. The first free port is
+	// used if 0.
+	Port int
+
+	// GPU is the GPU emulation mode (-gpu), e.g. "host",
+	// "swiftshader_indirect", or "auto".
+	GPU string
+
+	// RAMSize is the size of the emulator's RAM in megabytes (-memory). The
+	// AVD's hw.ramSize is used if 0.
+	RAMSize int
+
+	// Cores is the number of CPU cores of the emulator (-cores). The AVD's
+	// hw.cpu.ncore is used if 0.
+	Cores int
+
+	// ReadOnly starts the emulator with -read-only, so that changes to the AVD
+	// aren't saved. It allows running several instances of the same AVD.
+	ReadOnly bool
+
+	// WritableSystem makes the system image writable (-writable-system), for
+	// example, to remount it with adb remount.
+	WritableSystem bool
+
+	// HTTPProxy is the proxy used for all TCP connections of the emulator
+	// (-http-proxy), e.g. "http://proxy.example.com:3128".
+	HTTPProxy string
+
+	// DNSServers are used by the emulator instead of the host's DNS servers
+	// (-dns-server).
+	DNSServers []string
+
+	// CameraBack and CameraFront are the sources of the back and front camera
+	// (-camera-back, -camera-front), e.g. "emulated", "webcam0", or "none".
+	CameraBack  string
+	CameraFront string
+
+	// NetSpeed is the network speed (-netspeed), e.g. "full", "lte", or
+	// "<up>:<down>" in kbit/s.
+	NetSpeed string
+
+	// NetDelay is the network latency (-netdelay), e.g. "none", "gprs", or
+	// "<min>:<max>" in milliseconds.
+	NetDelay string
 
-	// Workaround for a bug in emulator v34
-	for i, avd := range avdsStr {
-		if strings.Contains(avd, "Storing crashdata") {
-			avdsStr = slices.Delete(avdsStr, i, i+1)
+	// Args are passed to the emulator after all other arguments.
+	Args []string
+
+	// Output, if not nil, receives output of the emulator in addition to the
+	// log file.
+	Output io.Writer
+}
+
+// args returns arguments of the emulator to start the AVD with name.
+func (o StartOptions) args(name string) ([]string, error) {
+	args := []string{fmt.Sprintf("@%s", name), "-no-boot-anim", "-no-audio"}
+
+	if o.NoWindow {
+		args = append(args, "-no-window")
+	}
+	if o.ColdBoot {
+		args = append(args, "-no-snapshot-load")
+	}
+	if o.WipeData {
+		args = append(args, "-wipe-data")
+	}
+	if o.Port != 0 {
+		if o.Port < minConsolePort || o.Port > maxConsolePort || o.Port%2 != 0 {
+			return nil, fmt.Errorf("invalid console port %d, must be an even number between %d and %d", o.Port, minConsolePort, maxConsolePort)
 		}
+		args = append(args, "-port", strconv.Itoa(o.Port))
 	}
-
-	// map avds to AVD struct
-	avds := make([]AVD, len(avdsStr))
-	for i, avd := range avdsStr {
-		avds[i] = AVD{Name: avd}
+	if o.GPU != "" {
+		args = append(args, "-gpu", o.GPU)
+	}
+	if o.RAMSize < 0 {
+		return nil, fmt.Errorf("invalid RAM size %d", o.RAMSize)
+	}
+	if o.RAMSize != 0 {
+		args = append(args, "-memory", strconv.Itoa(o.RAMSize))
+	}
+	if o.Cores < 0 {
+		return nil, fmt.Errorf("invalid number of cores %d", o.Cores)
+	}
+	if o.Cores != 0 {
+		args = append(args, "-cores", strconv.Itoa(o.Cores))
+	}
+	if o.ReadOnly {
+		args = append(args, "-read-only")
+	}
+	if o.WritableSystem {
+		args = append(args, "-writable-system")
+	}
+	if o.HTTPProxy != "" {
+		args = append(args, "-http-proxy", o.HTTPProxy)
+	}
+	if len(o.DNSServers) != 0 {
+		args = append(args, "-dns-server", strings.Join(o.DNSServers, ","))
+	}
+	if o.CameraBack != "" {
+		args = append(args, "-camera-back", o.CameraBack)
 	}
+	if o.CameraFront != "" {
+		args = append(args, "-camera-front", o.CameraFront)
+	}
+	if o.NetSpeed != "" {
+		args = append(args, "-netspeed", o.NetSpeed)
+	}
+	if o.NetDelay != "" {
+		args = append(args, "-netdelay", o.NetDelay)
+	}
+
+	return append(args, o.Args...), nil
+}
 
-	cmd = exec.Command(
-		"ps",
-		"-e",
-		"-ww", // don't truncate output
-		"-o", "pid=,comm=",
-	)
-	data, err = cmd.Output()
+// List returns a list of available AVDs and whether they're running or not.
+//
+// AVDs are discovered by reading <name>.ini files in AVDHome, so the emulator
+// doesn't have to be installed.
+func List() ([]AVD, error) {
+	return ListContext(context.Background())
+}
+
+// ListContext is like List but uses ctx to run external programs.
+func ListContext(ctx context.Context) ([]AVD, error) {
+	avdHome, err := AVDHome()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get processes: %v", err)
+		return nil, err
 	}
 
-	// parse output of ps
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		if !strings.Contains(line, "qemu-system") {
-			continue
-		}
-
-		// remove leading and trailing spaces
-		line = strings.Trim(line, " ")
+	avds, err := readAVDs(avdHome)
+	if err != nil {
+		return nil, err
+	}
 
-		fields := strings.Split(line, " ")
-		pid, err := strconv.Atoi(fields[0])
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse pid: %v", err)
-		}
+	procs, err := scanProcesses(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get processes: %w", err)
+	}
 
-		avdName := emuInPID(pid)
+	for _, proc := range procs {
 		for i, avd := range avds {
-			if avd.Name == avdName {
+			if avd.Name == proc.AVD {
 				avds[i].Running = true
-				avds[i].Pid = pid
+				avds[i].Instances = append(avds[i].Instances, proc.instance())
 			}
 		}
 	}
 
+	resolvePorts(ctx, avds)
+
 	return avds, nil
 }
 
 // Start starts the AVD with the given name.
 func Start(name string) error {
-	avds, err := List()
+	return StartContext(context.Background(), name)
+}
+
+// StartContext is like Start but uses ctx to run external programs. The
+// emulator keeps running after ctx is done.
+func StartContext(ctx context.Context, name string) error {
+	_, err := StartWithOptions(ctx, name, StartOptions{})
+	return err
+}
+
+// StartWithOptions is like StartContext but starts the AVD with opts, and
+// returns the started emulator. Output of the emulator is appended to the log
+// file at LogPath(name).
+//
+// An AVD that is already running can only be started again as read-only.
+func StartWithOptions(ctx context.Context, name string, opts StartOptions) (*Emulator, error) {
+	avds, err := ListContext(ctx)
 	if err != nil {
-		return fmt.Errorf("list avds: %v", err)
+		return nil, fmt.Errorf("list avds: %w", err)
 	}
 
 	for _, avd := range avds {
 		if avd.Name == name {
-			if avd.Running {
-				return fmt.Errorf("avd %s is already running", name)
+			if avd.Running && !opts.ReadOnly {
+				return nil, fmt.Errorf("%w: %s (only read-only instances can be added)", ErrAlreadyRunning, name)
+			}
+
+			args, err := opts.args(name)
+			if err != nil {
+				return nil, err
 			}
 
-			args := []string{fmt.Sprintf("@%s", name), "-no-boot-anim", "-no-audio"}
-			cmd := exec.Command("emulator", args...)
-			printInvocation(cmd)
-			err = cmd.Start()
+			emu, err := startEmulator(ctx, avd, args, opts)
 			if err != nil {
-				return fmt.Errorf("start avd %s: %v", name, err)
+				return nil, fmt.Errorf("start avd %s: %w", name, err)
 			}
 
-			return nil
+			return emu, nil
 		}
 	}
 
-	return fmt.Errorf("avd %s not found", name)
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
 }
 
-func EnableDarkTheme() error {
-	return adbShell("cmd", "uimode", "night", "yes")
-}
+// StartMany is like StartWithOptions but starts several AVDs at once. Each
+// emulator gets its own console port, so that they don't race for the same
+// free port. opts.Port can only be set if there's one name, and names must
+// not repeat.
+//
+// It returns emulators of AVDs that were started, in the order of names, and
+// errors of AVDs that weren't.
+func StartMany(ctx context.Context, names []string, opts StartOptions) ([]*Emulator, error) {
+	if opts.Port != 0 && len(names) > 1 {
+		return nil, fmt.Errorf("can't start %d avds on the same port %d", len(names), opts.Port)
+	}
+	if opts.Output != nil && len(names) > 1 {
+		return nil, fmt.Errorf("can't write output of %d avds to the same writer", len(names))
+	}
+	for i, name := range names {
+		if slices.Contains(names[:i], name) {
+			return nil, fmt.Errorf("avd %s given more than once", name)
+		}
+	}
 
-func DisableDarkTheme() error {
-	return adbShell("cmd", "uimode", "night", "no")
-}
+	ports := []int{opts.Port}
+	if len(names) > 1 {
+		var err error
+		ports, err = freePorts(ctx, len(names))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func ToggleDarkTheme() error {
-	cmd := exec.Command("adb", "shell", "cmd", "uimode", "night")
-	printInvocation(cmd)
-	out, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to run and read stdout: %v", err)
+	emus := make([]*Emulator, len(names))
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			opts := opts
+			opts.Port = ports[i]
+			emus[i], errs[i] = StartWithOptions(ctx, name, opts)
+		}()
 	}
-	output := string(out)
+	wg.Wait()
 
-	targetMode := "yes"
-	if output == "Night mode: yes\n" {
-		targetMode = "no"
+	var started []*Emulator
+	for _, emu := range emus {
+		if emu != nil {
+			started = append(started, emu)
+		}
 	}
 
-	return adbShell("cmd", "uimode", "night", targetMode)
+	return started, errors.Join(errs...)
 }
 
-func SetFontSize(value string) error {
-	return adbShell("settings", "put", "system", "font_scale", value)
+// RestartOptions configures how an AVD is restarted.
+type RestartOptions struct {
+	Stop StopOptions
+
+	// ColdBoot and WipeData are like in StartOptions. They apply only to this
+	// restart, even if the emulator was originally started with them.
+	ColdBoot bool
+	WipeData bool
 }
 
-func SetDisplaySize(value float32) error {
-	density, err := getDensity()
+// Restart stops the instance of the AVD, waits until it exited and released
+// the AVD's lock files, and starts it again with the arguments it was
+// originally started with.
+func (a AVD) Restart(ctx context.Context, instance Instance, opts RestartOptions) (*Emulator, error) {
+	err := instance.Stop(ctx, opts.Stop)
 	if err != nil {
-		return fmt.Errorf("failed to get density: %v", err)
+		return nil, fmt.Errorf("stop avd %s: %w", a.Name, err)
 	}
 
-	return adbShell("wm", "density", fmt.Sprintf("%d", int(float32(density)*value)))
-}
+	if !instance.ReadOnly {
+		err = waitForLocks(ctx, a.Path, lockTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func DisableAnimations() error {
-	var err error
-	err = adbShell("settings", "put", "global", "window_animation_scale", "0")
+	args := restartArgs(a.Name, instance.Args, instance.Port, opts)
+
+	// Get instances again, so that the serial of the stopped instance isn't
+	// treated as belonging to another one.
+	avds, err := ListContext(ctx)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("list avds: %w", err)
 	}
-	err = adbShell("settings", "put", "global", "transition_animation_scale", "0")
-	if err != nil {
-		return err
+	for _, avd := range avds {
+		if avd.Name == a.Name {
+			a = avd
+		}
 	}
-	err = adbShell("settings", "put", "global", "animator_duration_scale", "0")
-	return err
-}
 
-func EnableAnimations() error {
-	var err error
-	err = adbShell("settings", "put", "global", "window_animation_scale", "1")
+	emu, err := startEmulator(ctx, a, args, StartOptions{Port: instance.Port})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("start avd %s: %w", a.Name, err)
 	}
-	err = adbShell("settings", "put", "global", "transition_animation_scale", "1")
-	if err != nil {
-		return err
-	}
-	err = adbShell("settings", "put", "global", "animator_duration_scale", "1")
-	return err
+
+	return emu, nil
 }
 
-func ToggleAnimations() error {
-	// the 3 values are always in sync, so I think it's enough to get just a single one
-	cmd := exec.Command("adb", "shell", "settings", "get", "global", "window_animation_scale")
-	printInvocation(cmd)
-	out, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to run and read stdout: %v", err)
+// restartArgs returns arguments to restart the emulator of the AVD with name,
+// which was started with args and listened on the console port. The port is
+// pinned, so that the restarted emulator gets the same serial.
+func restartArgs(name string, args []string, port int, opts RestartOptions) []string {
+	if len(args) == 0 {
+		args, _ = StartOptions{}.args(name)
 	}
-	output := string(out)
 
-	// basic validation
-	if output != "0\n" && output != "1\n" {
-		return fmt.Errorf("unexpected output: %s", output)
+	var restart []string
+	for _, arg := range args {
+		// These apply only to a single boot.
+		if arg != "-wipe-data" && arg != "-no-snapshot-load" {
+			restart = append(restart, arg)
+		}
 	}
 
-	targetScale := "1"
-	if output == "1\n" {
-		targetScale = "0"
+	if opts.ColdBoot {
+		restart = append(restart, "-no-snapshot-load")
 	}
-
-	err = adbShell("settings", "put", "global", "window_animation_scale", targetScale)
-	if err != nil {
-		return err
+	if opts.WipeData {
+		restart = append(restart, "-wipe-data")
 	}
-	err = adbShell("settings", "put", "global", "transition_animation_scale", targetScale)
-	if err != nil {
-		return err
+	if port != 0 && !slices.Contains(restart, "-port") && !slices.Contains(restart, "-ports") {
+		restart = append(restart, "-port", strconv.Itoa(port))
 	}
-	err = adbShell("settings", "put", "global", "animator_duration_scale", targetScale)
-	return err
-}
 
-func getDensity() (int, error) {
-	cmd := exec.Command("adb", "shell", "wm", "density")
-	printInvocation(cmd)
-	out, err := cmd.Output()
-	if err != nil {
-		return 0, fmt.Errorf("failed to run: %v", err)
-	}
-	output := string(out)
+	return restart
+}
 
-	var density int
-	_, err = fmt.Sscanf(output, "Physical density: %d", &density)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse density: %v", err)
-	}
+const (
+	minConsolePort = 5554
+	maxConsolePort = 5682
+)
 
-	return density, nil
-}
+// freePorts returns n console ports that aren't used by running emulators or
+// other programs.
+func freePorts(ctx context.Context, n int) ([]int, error) {
+	used := make(map[int]bool)
 
-// emuInPID returns the name of the AVD that is running in process.
-//
-// Returns an empty string if the process isn't an emulator process.
-func emuInPID(pid int) string {
-	cmd := exec.Command(
-		"ps",
-		"-e",
-		"-ww", // don't truncate output
-		"-o", "args=",
-		"-p", strconv.Itoa(pid),
-	)
-	data, err := cmd.Output()
+	avds, err := ListContext(ctx)
 	if err != nil {
-		return ""
+		return nil, fmt.Errorf("list avds: %w", err)
+	}
+	for _, avd := range avds {
+		for _, instance := range avd.Instances {
+			used[instance.Port] = true
+		}
 	}
 
-	args := strings.Split(string(data), " ")
-	for _, arg := range args {
-		if strings.HasPrefix(arg, "@") {
-			return strings.TrimPrefix(arg, "@")
+	// Devices may be emulators of AVDs from another AVD home.
+	serials, _ := DevicesContext(ctx)
+	for _, serial := range serials {
+		port, err := NewDevice(serial).ConsolePort()
+		if err == nil {
+			used[port] = true
 		}
 	}
 
-	return ""
-}
+	var ports []int
+	for port := minConsolePort; port <= maxConsolePort && len(ports) < n; port += 2 {
+		if !used[port] && portFree(port) && portFree(port+1) {
+			ports = append(ports, port)
+		}
+	}
 
-func adbShell(cmd ...string) error {
-	args := []string{"shell"}
-	args = append(args, cmd...)
+	if len(ports) < n {
+		return nil, fmt.Errorf("only %d of %d console ports between %d and %d are free", len(ports), n, minConsolePort, maxConsolePort)
+	}
 
-	var stderr bytes.Buffer
+	return ports, nil
+}
 
-	adbCmd := exec.Command("adb", args...)
-	printInvocation(adbCmd)
-	adbCmd.Stderr = &stderr
-	err := adbCmd.Run()
+// portFree reports whether port can be listened on on localhost.
+func portFree(port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
 	if err != nil {
-		return fmt.Errorf("failed to run %s: %v, %v", cmd, err, stderr.String())
+		return false
 	}
-	return nil
+	l.Close()
+
+	return true
 }
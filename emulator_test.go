@@ -0,0 +1,378 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bartekpacia/emu/adb"
+)
+
+// useFakeRunner replaces CommandRunner with a FakeRunner returning outputs
+// for the duration of the test.
+func useFakeRunner(t *testing.T, outputs map[string]string) *FakeRunner {
+	t.Helper()
+
+	// Make sure tools are looked up in PATH, so that their invocations don't
+	// depend on where the SDK is installed.
+	t.Setenv("ANDROID_HOME", t.TempDir())
+
+	// Keep emulator logs out of the user's cache directory, and ignore
+	// discovery files of emulators running on this machine.
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	runner := &FakeRunner{Outputs: outputs}
+	prev := CommandRunner
+	CommandRunner = runner
+	t.Cleanup(func() { CommandRunner = prev })
+
+	// Make sure the adb executable is run instead of talking to the adb
+	// server, which may be running on this machine.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	prevClient := ADBClient
+	ADBClient = &adb.Client{Addr: listener.Addr().String()}
+	t.Cleanup(func() { ADBClient = prevClient })
+
+	return runner
+}
+
+// useADBServer points ADBClient to a fake adb server, which lists devices
+// as "<serial>\t<state>" lines, for the duration of the test. It must be
+// called after useFakeRunner.
+func useADBServer(t *testing.T, devices string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			var hexLen [4]byte
+			_, err = io.ReadFull(conn, hexLen[:])
+			n, _ := strconv.ParseUint(string(hexLen[:]), 16, 16)
+			req := make([]byte, n)
+			if err == nil {
+				_, err = io.ReadFull(conn, req)
+			}
+			if err == nil && string(req) == "host:devices" {
+				fmt.Fprintf(conn, "OKAY%04x%s", len(devices), devices)
+			} else {
+				fmt.Fprintf(conn, "FAIL%04x%s", len("unknown request"), "unknown request")
+			}
+			conn.Close()
+		}
+	}()
+
+	prev := ADBClient
+	ADBClient = &adb.Client{Addr: listener.Addr().String()}
+	t.Cleanup(func() { ADBClient = prev })
+}
+
+// useAVDHome creates a temporary AVD home with AVDs named names and points
+// ANDROID_AVD_HOME to it for the duration of the test.
+func useAVDHome(t *testing.T, names ...string) string {
+	t.Helper()
+
+	avdHome := t.TempDir()
+	t.Setenv("ANDROID_AVD_HOME", avdHome)
+
+	for _, name := range names {
+		ini := fmt.Sprintf("avd.ini.encoding=UTF-8\npath=%s\npath.rel=avd/%s.avd\ntarget=android-34\n", filepath.Join(avdHome, name+".avd"), name)
+		err := os.WriteFile(filepath.Join(avdHome, name+".ini"), []byte(ini), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return avdHome
+}
+
+// useProcRoot points procRoot to dir for the duration of the test. If dir
+// doesn't exist, running emulators are looked up with ps.
+func useProcRoot(t *testing.T, dir string) {
+	t.Helper()
+
+	prev := procRoot
+	procRoot = dir
+	t.Cleanup(func() { procRoot = prev })
+}
+
+func TestList(t *testing.T) {
+	avdHome := useAVDHome(t, "Pixel_9_API_35", "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	useFakeRunner(t, map[string]string{
+		"ps -e -ww -o pid=,comm=": "    1 init\n" +
+			" 4242 qemu-system-aarch64\n" +
+			" 4300 bash\n",
+		"ps -ww -o args= -p 4242": "/sdk/emulator/qemu/darwin-aarch64/qemu-system-aarch64 -netdelay none @Pixel_9_API_35 -no-audio\n",
+	})
+
+	avds, err := List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+
+	want := []AVD{
+		{Name: "Pixel_7_API_34", Path: filepath.Join(avdHome, "Pixel_7_API_34.avd"), Target: "android-34"},
+		{Name: "Pixel_9_API_35", Path: filepath.Join(avdHome, "Pixel_9_API_35.avd"), Target: "android-34", Running: true, Instances: []Instance{{Pid: 4242, Args: []string{"-netdelay", "none", "@Pixel_9_API_35", "-no-audio"}}}},
+	}
+	if !reflect.DeepEqual(avds, want) {
+		t.Errorf("List() = %v, want %v", avds, want)
+	}
+}
+
+func TestStart(t *testing.T) {
+	useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	runner := useFakeRunner(t, nil)
+
+	err := Start("Pixel_7_API_34")
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	calls := runner.Calls()
+	want := "emulator @Pixel_7_API_34 -no-boot-anim -no-audio"
+	if calls[len(calls)-1] != want {
+		t.Errorf("last invocation = %q, want %q", calls[len(calls)-1], want)
+	}
+}
+
+func TestStartReadOnly(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("running emulators are faked with /proc")
+	}
+
+	useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, writeProcRoot(t, map[string][]string{
+		"4242": {"/sdk/emulator/qemu/linux-x86_64/qemu-system-x86_64", "@Pixel_7_API_34"},
+	}))
+	runner := useFakeRunner(t, nil)
+
+	err := Start("Pixel_7_API_34")
+	if !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("Start() error = %v, want %v", err, ErrAlreadyRunning)
+	}
+
+	_, err = StartWithOptions(context.Background(), "Pixel_7_API_34", StartOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("StartWithOptions() error: %v", err)
+	}
+
+	calls := runner.Calls()
+	want := "emulator @Pixel_7_API_34 -no-boot-anim -no-audio -read-only"
+	if calls[len(calls)-1] != want {
+		t.Errorf("last invocation = %q, want %q", calls[len(calls)-1], want)
+	}
+}
+
+func TestStartNotFound(t *testing.T) {
+	useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	runner := useFakeRunner(t, nil)
+
+	err := Start("Pixel_9_API_35")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Start() error = %v, want %v", err, ErrNotFound)
+	}
+
+	for _, call := range runner.Calls() {
+		if call == "emulator @Pixel_9_API_35 -no-boot-anim -no-audio" {
+			t.Errorf("emulator was started for missing AVD")
+		}
+	}
+}
+
+func TestListToolMissing(t *testing.T) {
+	useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	runner := useFakeRunner(t, nil)
+	runner.Errors = map[string]error{
+		"ps -e -ww -o pid=,comm=": &ToolError{Name: "ps", Err: &exec.Error{Name: "ps", Err: exec.ErrNotFound}},
+	}
+
+	_, err := List()
+	if !errors.Is(err, ErrToolMissing) {
+		t.Errorf("List() error = %v, want %v", err, ErrToolMissing)
+	}
+}
+
+func TestStartOptionsArgs(t *testing.T) {
+	tests := []struct {
+		opts    StartOptions
+		want    string
+		wantErr bool
+	}{
+		{
+			opts: StartOptions{},
+			want: "@Pixel_7_API_34 -no-boot-anim -no-audio",
+		},
+		{
+			opts: StartOptions{NoWindow: true, ColdBoot: true, Port: 5560, GPU: "swiftshader_indirect", RAMSize: 4096, Cores: 4},
+			want: "@Pixel_7_API_34 -no-boot-anim -no-audio -no-window -no-snapshot-load -port 5560 -gpu swiftshader_indirect -memory 4096 -cores 4",
+		},
+		{
+			opts: StartOptions{DNSServers: []string{"1.1.1.1", "8.8.8.8"}, NetSpeed: "lte", NetDelay: "gprs", Args: []string{"-verbose"}},
+			want: "@Pixel_7_API_34 -no-boot-anim -no-audio -dns-server 1.1.1.1,8.8.8.8 -netspeed lte -netdelay gprs -verbose",
+		},
+		{opts: StartOptions{Port: 5555}, wantErr: true},
+		{opts: StartOptions{Port: 5700}, wantErr: true},
+		{opts: StartOptions{Cores: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		args, err := tt.opts.args("Pixel_7_API_34")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("args(%+v) error = nil, want error", tt.opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("args(%+v) error: %v", tt.opts, err)
+			continue
+		}
+
+		if got := strings.Join(args, " "); got != tt.want {
+			t.Errorf("args(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestStartMany(t *testing.T) {
+	useAVDHome(t, "Pixel_9_API_35", "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	useFakeRunner(t, map[string]string{
+		"adb devices": "List of devices attached\nemulator-5554\tdevice\n\n",
+	})
+
+	emus, err := StartMany(context.Background(), []string{"Pixel_9_API_35", "Pixel_7_API_34"}, StartOptions{})
+	if err != nil {
+		t.Fatalf("StartMany() error: %v", err)
+	}
+	if len(emus) != 2 {
+		t.Fatalf("StartMany() started %d emulators, want 2", len(emus))
+	}
+
+	if emus[0].Name != "Pixel_9_API_35" || emus[1].Name != "Pixel_7_API_34" {
+		t.Errorf("StartMany() started %s and %s, want them in order of names", emus[0].Name, emus[1].Name)
+	}
+	for _, emu := range emus {
+		if emu.Port == 0 || emu.Port == 5554 {
+			t.Errorf("emulator of %s got port %d, want a free port", emu.Name, emu.Port)
+		}
+	}
+	if emus[0].Port == emus[1].Port {
+		t.Errorf("emulators got the same port %d", emus[0].Port)
+	}
+
+	_, err = StartMany(context.Background(), []string{"Pixel_9_API_35", "Pixel_7_API_34"}, StartOptions{Port: 5556})
+	if err == nil {
+		t.Errorf("StartMany() with a port for two avds: error = nil, want error")
+	}
+
+	_, err = StartMany(context.Background(), []string{"Pixel_9_API_35", "Pixel_9_API_35"}, StartOptions{})
+	if err == nil {
+		t.Errorf("StartMany() with a repeated avd: error = nil, want error")
+	}
+}
+
+func TestListResolvesPorts(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("running emulators are faked with /proc")
+	}
+
+	useAVDHome(t, "Pixel_7_API_34", "Pixel_9_API_35", "Pixel_Fold_API_35")
+	useProcRoot(t, writeProcRoot(t, map[string][]string{
+		"4242": {"/sdk/emulator/qemu/linux-x86_64/qemu-system-x86_64", "@Pixel_7_API_34"},
+		"4343": {"/sdk/emulator/qemu/linux-x86_64/qemu-system-x86_64", "@Pixel_9_API_35"},
+		"4444": {"/sdk/emulator/qemu/linux-x86_64/qemu-system-x86_64", "@Pixel_Fold_API_35", "-port", "5560"},
+	}))
+	useFakeRunner(t, map[string]string{
+		"adb -s emulator-5556 emu avd name": "Pixel_Other_API_35\r\nOK\r\n",
+		"adb -s emulator-5558 emu avd name": "Pixel_9_API_35\r\nOK\r\n",
+	})
+	useADBServer(t, "emulator-5556\tdevice\nemulator-5558\tdevice\nemulator-5560\tdevice\nemulator-5562\toffline\n")
+
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	discoveryDir := filepath.Join(runtimeDir, "avd", "running")
+	err := os.MkdirAll(discoveryDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(discoveryDir, "pid_4242.ini"), []byte("port.serial=5554\nport.adb=5555\navd.name=Pixel_7_API_34\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	avds, err := List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+
+	want := map[string]string{
+		"Pixel_7_API_34":    "emulator-5554",
+		"Pixel_9_API_35":    "emulator-5558",
+		"Pixel_Fold_API_35": "emulator-5560",
+	}
+	for _, avd := range avds {
+		if len(avd.Instances) != 1 {
+			t.Errorf("%s has %d instances, want 1", avd.Name, len(avd.Instances))
+			continue
+		}
+		if serial := avd.Instances[0].Serial; serial != want[avd.Name] {
+			t.Errorf("%s serial = %q, want %q", avd.Name, serial, want[avd.Name])
+		}
+	}
+}
+
+func TestListDoesNotStartADBServer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("running emulators are faked with /proc")
+	}
+
+	useAVDHome(t, "Pixel_9_API_35")
+	useProcRoot(t, writeProcRoot(t, map[string][]string{
+		"4343": {"/sdk/emulator/qemu/linux-x86_64/qemu-system-x86_64", "@Pixel_9_API_35"},
+	}))
+	runner := useFakeRunner(t, nil)
+
+	avds, err := List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+
+	// The adb server isn't running, so the port stays unknown.
+	if port := avds[0].Instances[0].Port; port != 0 {
+		t.Errorf("port = %d, want 0", port)
+	}
+	if calls := runner.Calls(); len(calls) != 0 {
+		t.Errorf("invocations = %q, want none", calls)
+	}
+}
@@ -0,0 +1,65 @@
+package emulator
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when an AVD with the given name doesn't exist.
+	ErrNotFound = errors.New("avd not found")
+
+	// ErrExists is returned when an AVD can't be created, because an AVD
+	// with the same name already exists.
+	ErrExists = errors.New("avd already exists")
+
+	// ErrAlreadyRunning is returned when an AVD is expected not to be running,
+	// but it is.
+	ErrAlreadyRunning = errors.New("avd already running")
+
+	// ErrNotRunning is returned when an AVD or device is expected to be
+	// running, but it isn't.
+	ErrNotRunning = errors.New("avd not running")
+
+	// ErrToolMissing is returned when the Android SDK or one of its tools,
+	// such as adb or emulator, can't be found.
+	ErrToolMissing = errors.New("android sdk tool missing")
+
+	// ErrUnexpectedOutput is returned when the output of a tool can't be
+	// parsed.
+	ErrUnexpectedOutput = errors.New("unexpected tool output")
+)
+
+// ToolError is returned when an external program fails to start or exits
+// with an error.
+//
+// It matches ErrToolMissing if the program couldn't be found.
+type ToolError struct {
+	// Name of the program, for example, "adb".
+	Name string
+	Args []string
+
+	// Stderr is the standard error of the program, if it was captured.
+	Stderr string
+
+	// Err is the underlying error, usually *exec.Error or *exec.ExitError.
+	Err error
+}
+
+func (e *ToolError) Error() string {
+	msg := e.Err.Error()
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+
+	return msg
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ToolError) Is(target error) bool {
+	return target == ErrToolMissing && errors.Is(e.Err, exec.ErrNotFound)
+}
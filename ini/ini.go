@@ -0,0 +1,248 @@
+// Package ini reads and writes the ini files of Android Virtual Devices, such
+// as config.ini, hardware-qemu.ini, and <name>.ini in the AVD home.
+//
+// These files consist of key=value lines, with optional spaces around "=".
+// There are no sections. Lines starting with "#" or ";" are comments.
+//
+// Files are edited in place: order of keys, comments, blank lines, and
+// formatting of lines that aren't changed are preserved.
+package ini
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// File is the content of an ini file.
+type File struct {
+	lines []line
+
+	// crlf is true if lines end with "\r\n" rather than "\n".
+	crlf bool
+
+	// noFinalNewline is true if the last line doesn't end with a newline.
+	noFinalNewline bool
+}
+
+// line is a single line of a File.
+type line struct {
+	// raw is the line as read, without the line ending. It's used to write
+	// lines that weren't changed.
+	raw string
+
+	// key and value are set if the line is a key=value pair.
+	key   string
+	value string
+
+	// sep is the separator between key and value, e.g. "=" or " = ".
+	sep string
+}
+
+func (l line) isPair() bool {
+	return l.key != ""
+}
+
+// Parse parses the content of an ini file.
+func Parse(data []byte) *File {
+	f := &File{}
+	if len(data) == 0 {
+		return f
+	}
+
+	text := string(data)
+	f.crlf = strings.Contains(text, "\r\n")
+	f.noFinalNewline = !strings.HasSuffix(text, "\n")
+	text = strings.TrimSuffix(text, "\n")
+
+	for _, raw := range strings.Split(text, "\n") {
+		f.lines = append(f.lines, parseLine(strings.TrimSuffix(raw, "\r")))
+	}
+
+	return f
+}
+
+func parseLine(raw string) line {
+	l := line{raw: raw}
+
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";") {
+		return l
+	}
+
+	i := strings.Index(raw, "=")
+	if i == -1 {
+		return l
+	}
+
+	key := strings.TrimSpace(raw[:i])
+	if key == "" {
+		return l
+	}
+
+	// Keep the spaces around "=", so that lines added later look the same.
+	start := len(strings.TrimRight(raw[:i], " \t"))
+	end := i + 1 + len(raw[i+1:]) - len(strings.TrimLeft(raw[i+1:], " \t"))
+
+	l.key = key
+	l.value = strings.TrimSpace(raw[end:])
+	l.sep = raw[start:end]
+	return l
+}
+
+// Load reads the ini file at path.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return Parse(data), nil
+}
+
+// Get returns the value of key and whether it's set. If key is set more than
+// once, the first value is returned.
+func (f *File) Get(key string) (string, bool) {
+	i := f.index(key)
+	if i == -1 {
+		return "", false
+	}
+
+	return f.lines[i].value, true
+}
+
+// Value returns the value of key, or an empty string if it isn't set.
+func (f *File) Value(key string) string {
+	value, _ := f.Get(key)
+	return value
+}
+
+// Keys returns keys that are set, in order.
+func (f *File) Keys() []string {
+	var keys []string
+	for _, l := range f.lines {
+		if l.isPair() {
+			keys = append(keys, l.key)
+		}
+	}
+
+	return keys
+}
+
+// Set sets key to value. If key isn't set yet, it's added at the end.
+func (f *File) Set(key, value string) {
+	i := f.index(key)
+	if i == -1 {
+		f.lines = append(f.lines, f.newLine(key, value))
+		return
+	}
+
+	if f.lines[i].value != value {
+		l := f.lines[i]
+		f.lines[i] = line{raw: l.raw[:len(l.raw)-len(strings.TrimLeft(l.raw, " \t"))] + key + l.sep + value, key: key, value: value, sep: l.sep}
+	}
+}
+
+// Add adds key with value at the end. It fails if key is already set.
+func (f *File) Add(key, value string) error {
+	if f.index(key) != -1 {
+		return fmt.Errorf("key %s already set", key)
+	}
+
+	f.lines = append(f.lines, f.newLine(key, value))
+	return nil
+}
+
+// Delete removes all lines setting key, and reports whether there were any.
+func (f *File) Delete(key string) bool {
+	n := len(f.lines)
+	f.lines = slices.DeleteFunc(f.lines, func(l line) bool { return l.key == key })
+
+	return len(f.lines) != n
+}
+
+// Bytes returns the content of the file.
+func (f *File) Bytes() []byte {
+	eol := "\n"
+	if f.crlf {
+		eol = "\r\n"
+	}
+
+	var buf bytes.Buffer
+	for i, l := range f.lines {
+		buf.WriteString(l.raw)
+		if i < len(f.lines)-1 || !f.noFinalNewline {
+			buf.WriteString(eol)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// Save writes the file to path atomically: the content is written to a
+// temporary file in the same directory, which then replaces the file at path.
+// Permissions of an existing file are kept.
+func (f *File) Save(path string) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(f.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", tmp.Name(), err)
+	}
+
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return fmt.Errorf("chmod %s: %w", tmp.Name(), err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("replace %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (f *File) index(key string) int {
+	for i, l := range f.lines {
+		if l.key == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// newLine returns a line setting key to value, formatted like other lines of
+// the file. The line must be appended to the file.
+func (f *File) newLine(key, value string) line {
+	f.noFinalNewline = false
+
+	sep := "="
+	for _, l := range f.lines {
+		if l.isPair() {
+			sep = l.sep
+			break
+		}
+	}
+
+	return line{raw: key + sep + value, key: key, value: value, sep: sep}
+}
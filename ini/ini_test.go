@@ -0,0 +1,133 @@
+package ini
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"avd.ini.encoding=UTF-8\npath=/home/user/.android/avd/Pixel_7_API_34.avd\npath.rel=avd/Pixel_7_API_34.avd\ntarget=android-34\n",
+		"# comment\n\nhw.cpu.ncore = 4\n  disk.dataPartition.size = 6G\n; other comment\nnot a pair\n",
+		"hw.keyboard=no\r\nhw.lcd.density=420\r\n",
+		"no.final.newline=true",
+		"empty.value=\nspaces.in.value = a b c \n",
+	}
+
+	for _, data := range tests {
+		got := string(Parse([]byte(data)).Bytes())
+		if got != data {
+			t.Errorf("Parse(%q).Bytes() = %q", data, got)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	f := Parse([]byte("# hw.keyboard=yes\nhw.keyboard = no\nimage.sysdir.1=system-images/android-34/google_apis/x86_64/\nhw.keyboard=yes\nempty=\n"))
+
+	tests := []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{key: "hw.keyboard", want: "no", wantOK: true},
+		{key: "image.sysdir.1", want: "system-images/android-34/google_apis/x86_64/", wantOK: true},
+		{key: "empty", want: "", wantOK: true},
+		{key: "missing", want: "", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		got, ok := f.Get(tt.key)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("Get(%q) = %q, %v, want %q, %v", tt.key, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	wantKeys := []string{"hw.keyboard", "image.sysdir.1", "hw.keyboard", "empty"}
+	if keys := f.Keys(); !slices.Equal(keys, wantKeys) {
+		t.Errorf("Keys() = %q, want %q", keys, wantKeys)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	f := Parse([]byte("# Pixel 7\nhw.cpu.ncore = 4\nhw.keyboard = no\nhw.ramSize = 2048\n"))
+
+	f.Set("hw.keyboard", "yes")
+	f.Set("vm.heapSize", "1024M")
+	if f.Delete("hw.ramSize") != true {
+		t.Errorf("Delete() of set key = false, want true")
+	}
+	if f.Delete("missing") != false {
+		t.Errorf("Delete() of missing key = true, want false")
+	}
+
+	err := f.Add("hw.gpu.enabled", "yes")
+	if err != nil {
+		t.Errorf("Add() error: %v", err)
+	}
+	err = f.Add("hw.cpu.ncore", "8")
+	if err == nil {
+		t.Errorf("Add() of set key: error = nil, want error")
+	}
+
+	want := "# Pixel 7\nhw.cpu.ncore = 4\nhw.keyboard = yes\nvm.heapSize = 1024M\nhw.gpu.enabled = yes\n"
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("Bytes() = %q, want %q", got, want)
+	}
+}
+
+func TestEditNoFinalNewline(t *testing.T) {
+	f := Parse([]byte("hw.keyboard=no"))
+	f.Set("hw.ramSize", "4G")
+
+	want := "hw.keyboard=no\nhw.ramSize=4G\n"
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("Bytes() = %q, want %q", got, want)
+	}
+}
+
+func TestSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	err := os.WriteFile(path, []byte("hw.keyboard=no\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+
+	f.Set("hw.keyboard", "yes")
+	err = f.Save(path)
+	if err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hw.keyboard=yes\n" {
+		t.Errorf("saved content = %q, want %q", data, "hw.keyboard=yes\n")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("saved file mode = %v, want %v", info.Mode().Perm(), os.FileMode(0o600))
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory contains %d files after Save(), want 1", len(entries))
+	}
+}
@@ -0,0 +1,180 @@
+package emulator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// procRoot is where the proc filesystem is mounted on Linux.
+var procRoot = "/proc"
+
+// emulatorProcess is a running emulator process.
+type emulatorProcess struct {
+	Pid int
+
+	// AVD is the name of the AVD the process runs.
+	AVD string
+
+	// Port is the console port passed with -port or -ports. Equals 0 if the
+	// emulator picked the port itself.
+	Port int
+
+	NoWindow bool
+	ReadOnly bool
+
+	// Args are the command line arguments of the process, without the
+	// executable.
+	Args []string
+}
+
+func (p emulatorProcess) instance() Instance {
+	instance := Instance{Pid: p.Pid, Port: p.Port, ReadOnly: p.ReadOnly, Args: p.Args}
+	if p.Port != 0 {
+		instance.Serial = fmt.Sprintf("emulator-%d", p.Port)
+	}
+
+	return instance
+}
+
+// scanProcesses returns running emulator processes.
+//
+// On Linux, it reads command lines of processes from /proc. Elsewhere, or if
+// /proc can't be read, it falls back to ps.
+func scanProcesses(ctx context.Context) ([]emulatorProcess, error) {
+	if runtime.GOOS == "linux" {
+		procs, err := procProcesses(procRoot)
+		if err == nil {
+			return procs, nil
+		}
+	}
+
+	return psProcesses(ctx)
+}
+
+// procProcesses returns emulator processes found in the proc filesystem
+// mounted at root.
+func procProcesses(root string) ([]emulatorProcess, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("read directory %s: %w", root, err)
+	}
+
+	var procs []emulatorProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// The process may have exited in the meantime, or belong to another
+		// user, so errors are ignored.
+		data, err := os.ReadFile(filepath.Join(root, entry.Name(), "cmdline"))
+		if err != nil || len(data) == 0 {
+			continue
+		}
+
+		args := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+		if !isEmulatorProcess(args[0]) {
+			continue
+		}
+
+		proc := parseEmulatorArgs(pid, args[1:])
+		if proc.AVD != "" {
+			procs = append(procs, proc)
+		}
+	}
+
+	return procs, nil
+}
+
+// psProcesses returns emulator processes found with ps.
+//
+// Arguments printed by ps are separated with spaces, so AVD names and paths
+// containing spaces aren't handled correctly.
+func psProcesses(ctx context.Context) ([]emulatorProcess, error) {
+	data, err := CommandRunner.Run(
+		ctx,
+		"ps",
+		"-e",
+		"-ww", // don't truncate output
+		"-o", "pid=,comm=",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var procs []emulatorProcess
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.Contains(line, "qemu-system") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pid: %w: %v", ErrUnexpectedOutput, err)
+		}
+
+		data, err := CommandRunner.Run(
+			ctx,
+			"ps",
+			"-ww", // don't truncate output
+			"-o", "args=",
+			"-p", strconv.Itoa(pid),
+		)
+		if err != nil {
+			// The process may have exited in the meantime.
+			continue
+		}
+
+		args := strings.Fields(string(data))
+		if len(args) == 0 {
+			continue
+		}
+
+		proc := parseEmulatorArgs(pid, args[1:])
+		if proc.AVD != "" {
+			procs = append(procs, proc)
+		}
+	}
+
+	return procs, nil
+}
+
+// isEmulatorProcess reports whether the executable at path is the emulator's
+// qemu, which runs the AVD.
+func isEmulatorProcess(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), "qemu-system")
+}
+
+// parseEmulatorArgs parses command line arguments (without the executable) of
+// the emulator process with pid.
+func parseEmulatorArgs(pid int, args []string) emulatorProcess {
+	proc := emulatorProcess{Pid: pid, Args: args}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			proc.AVD = strings.TrimPrefix(arg, "@")
+		case arg == "-avd" && i+1 < len(args):
+			i++
+			proc.AVD = args[i]
+		case (arg == "-port" || arg == "-ports") && i+1 < len(args):
+			i++
+			// -ports is <console-port>,<adb-port>
+			port, _, _ := strings.Cut(args[i], ",")
+			proc.Port, _ = strconv.Atoi(port)
+		case arg == "-no-window":
+			proc.NoWindow = true
+		case arg == "-read-only":
+			proc.ReadOnly = true
+		}
+	}
+
+	return proc
+}
@@ -0,0 +1,64 @@
+package emulator
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeProcRoot creates a fake proc filesystem with processes running
+// cmdlines, keyed by pid.
+func writeProcRoot(t *testing.T, cmdlines map[string][]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for pid, args := range cmdlines {
+		err := os.MkdirAll(filepath.Join(root, pid), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmdline := strings.Join(args, "\x00") + "\x00"
+		err = os.WriteFile(filepath.Join(root, pid, "cmdline"), []byte(cmdline), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func TestProcProcesses(t *testing.T) {
+	root := writeProcRoot(t, map[string][]string{
+		"1":    {"/sbin/init"},
+		"4242": {"/opt/android sdk/emulator/qemu/linux-x86_64/qemu-system-x86_64", "-netdelay", "none", "-avd", "My Pixel", "-port", "5556", "-no-window", "-read-only"},
+		"4300": {"/opt/android sdk/emulator/emulator", "@Pixel_7_API_34"},
+		"4301": {"/opt/android sdk/emulator/qemu/linux-x86_64/qemu-system-x86_64", "@Pixel_7_API_34", "-no-audio"},
+		"self": {"/usr/bin/go"},
+	})
+
+	procs, err := procProcesses(root)
+	if err != nil {
+		t.Fatalf("procProcesses() error: %v", err)
+	}
+
+	want := []emulatorProcess{
+		{Pid: 4242, AVD: "My Pixel", Port: 5556, NoWindow: true, ReadOnly: true, Args: []string{"-netdelay", "none", "-avd", "My Pixel", "-port", "5556", "-no-window", "-read-only"}},
+		{Pid: 4301, AVD: "Pixel_7_API_34", Args: []string{"@Pixel_7_API_34", "-no-audio"}},
+	}
+	if !reflect.DeepEqual(procs, want) {
+		t.Errorf("procProcesses() = %+v, want %+v", procs, want)
+	}
+}
+
+func TestParseEmulatorArgs(t *testing.T) {
+	args := []string{"@Pixel_9_API_35", "-ports", "5560,5561"}
+	proc := parseEmulatorArgs(1, args)
+
+	want := emulatorProcess{Pid: 1, AVD: "Pixel_9_API_35", Port: 5560, Args: args}
+	if !reflect.DeepEqual(proc, want) {
+		t.Errorf("parseEmulatorArgs() = %+v, want %+v", proc, want)
+	}
+}
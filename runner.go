@@ -0,0 +1,189 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Runner runs external programs, such as emulator, adb, or sdkmanager.
+type Runner interface {
+	// Run runs the program name with args, waits for it to exit, and returns
+	// its standard output. If the program fails, the error includes its
+	// standard error. The program is killed if ctx is done before it exits.
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+
+	// Start starts the program name with args and doesn't wait for it to exit.
+	// Its standard output and error are written to output, or discarded if
+	// output is nil. The program keeps running after ctx is done, and doesn't
+	// receive signals sent to the process group of this program, such as
+	// SIGINT on Ctrl-C.
+	Start(ctx context.Context, output io.Writer, name string, args ...string) (Process, error)
+}
+
+// Process is a program started by a Runner.
+type Process interface {
+	Pid() int
+
+	// Signal sends sig to the program.
+	Signal(sig os.Signal) error
+
+	// Wait waits for the program to exit. It must be called at most once.
+	Wait() error
+}
+
+// CommandRunner runs all external programs invoked by this package.
+//
+// Replace it, for example, with a FakeRunner, to use the package without the
+// Android SDK. It must not be changed while other functions of this package
+// are running.
+var CommandRunner Runner = ExecRunner{}
+
+// ExecRunner is a Runner that runs programs with os/exec.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	printInvocation(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return out, fmt.Errorf("%s: %w", name, ctx.Err())
+		}
+
+		toolErr := &ToolError{Name: name, Args: args, Err: err}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			toolErr.Stderr = string(exitErr.Stderr)
+		}
+		return out, toolErr
+	}
+
+	return out, nil
+}
+
+func (ExecRunner) Start(ctx context.Context, output io.Writer, name string, args ...string) (Process, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	setProcessGroup(cmd)
+	printInvocation(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return nil, &ToolError{Name: name, Args: args, Err: err}
+	}
+
+	return execProcess{cmd}, nil
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p execProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p execProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p execProcess) Wait() error {
+	err := p.cmd.Wait()
+	if err != nil {
+		return &ToolError{Name: p.cmd.Path, Args: p.cmd.Args[1:], Err: err}
+	}
+
+	return nil
+}
+
+// FakeRunner is a Runner that records invocations instead of running
+// programs, and returns canned outputs for them.
+//
+// Invocations are identified by their command line, that is, the program
+// name and arguments joined with spaces, for example, "adb devices".
+type FakeRunner struct {
+	// Outputs maps command lines to standard outputs returned by Run.
+	Outputs map[string]string
+
+	// Errors maps command lines to errors returned by Run and Start.
+	Errors map[string]error
+
+	// Exits maps command lines of programs started with Start to errors
+	// returned by Wait of their processes. Processes of programs not in
+	// Exits never exit.
+	Exits map[string]error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *FakeRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	line := f.record(name, args)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return []byte(f.Outputs[line]), f.Errors[line]
+}
+
+func (f *FakeRunner) Start(ctx context.Context, output io.Writer, name string, args ...string) (Process, error) {
+	line := f.record(name, args)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := f.Errors[line]; err != nil {
+		return nil, err
+	}
+
+	exitErr, exits := f.Exits[line]
+	return fakeProcess{exits: exits, err: exitErr}, nil
+}
+
+type fakeProcess struct {
+	exits bool
+	err   error
+}
+
+func (p fakeProcess) Pid() int {
+	return 0
+}
+
+func (p fakeProcess) Signal(sig os.Signal) error {
+	return nil
+}
+
+func (p fakeProcess) Wait() error {
+	if !p.exits {
+		select {}
+	}
+
+	return p.err
+}
+
+// Calls returns command lines of all invocations, in order.
+func (f *FakeRunner) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.calls...)
+}
+
+func (f *FakeRunner) record(name string, args []string) string {
+	line := strings.Join(append([]string{name}, args...), " ")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, line)
+	return line
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package emulator
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package emulator
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd run in its own process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,227 @@
+package emulator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SDK holds locations of the Android SDK, its tools, and the directories
+// where Android tools store user data.
+type SDK struct {
+	// Root is the directory the Android SDK is installed in. Empty if it
+	// couldn't be found.
+	Root string
+
+	// UserHome is the directory where Android tools store user data, e.g.
+	// ~/.android. Empty if it couldn't be determined.
+	UserHome string
+
+	// AVDHome is the directory where AVDs are stored, e.g. ~/.android/avd.
+	// Empty if it couldn't be determined.
+	AVDHome string
+}
+
+// LocateSDK finds the Android SDK and user data directories.
+//
+// The SDK root is resolved from the first of:
+//   - $ANDROID_HOME
+//   - $ANDROID_SDK_ROOT
+//   - ~/Library/Android/sdk on macOS, %LOCALAPPDATA%\Android\Sdk on
+//     Windows, ~/Android/Sdk elsewhere, if it exists
+//
+// The user home is resolved from the first of:
+//   - $ANDROID_USER_HOME
+//   - $ANDROID_SDK_HOME/.android
+//   - ~/.android
+//
+// The AVD home is resolved the same way the emulator does it, from the first
+// of:
+//   - $ANDROID_AVD_HOME
+//   - $ANDROID_USER_HOME/avd
+//   - $ANDROID_EMULATOR_HOME/avd
+//   - <user home>/avd
+func LocateSDK() SDK {
+	var sdk SDK
+
+	home, _ := os.UserHomeDir()
+
+	sdk.Root = os.Getenv("ANDROID_HOME")
+	if sdk.Root == "" {
+		sdk.Root = os.Getenv("ANDROID_SDK_ROOT")
+	}
+	if sdk.Root == "" && home != "" {
+		defaultRoot := filepath.Join(home, "Android", "Sdk")
+		switch runtime.GOOS {
+		case "darwin":
+			defaultRoot = filepath.Join(home, "Library", "Android", "sdk")
+		case "windows":
+			if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+				defaultRoot = filepath.Join(dir, "Android", "Sdk")
+			}
+		}
+
+		if isDir(defaultRoot) {
+			sdk.Root = defaultRoot
+		}
+	}
+
+	if dir := os.Getenv("ANDROID_USER_HOME"); dir != "" {
+		sdk.UserHome = dir
+	} else if dir := os.Getenv("ANDROID_SDK_HOME"); dir != "" {
+		sdk.UserHome = filepath.Join(dir, ".android")
+	} else if home != "" {
+		sdk.UserHome = filepath.Join(home, ".android")
+	}
+
+	if dir := os.Getenv("ANDROID_AVD_HOME"); dir != "" {
+		sdk.AVDHome = dir
+	} else if dir := os.Getenv("ANDROID_USER_HOME"); dir != "" {
+		sdk.AVDHome = filepath.Join(dir, "avd")
+	} else if dir := os.Getenv("ANDROID_EMULATOR_HOME"); dir != "" {
+		sdk.AVDHome = filepath.Join(dir, "avd")
+	} else if sdk.UserHome != "" {
+		sdk.AVDHome = filepath.Join(sdk.UserHome, "avd")
+	}
+
+	return sdk
+}
+
+// AVDHome returns the directory where AVDs are stored. See LocateSDK for how
+// it's resolved.
+func AVDHome() (string, error) {
+	return LocateSDK().avdHome()
+}
+
+// Emulator returns the path of the emulator executable.
+func (s SDK) Emulator() string {
+	return s.tool("emulator", filepath.Join("emulator", executable("emulator")))
+}
+
+// ADB returns the path of the adb executable.
+func (s SDK) ADB() string {
+	return s.tool("adb", filepath.Join("platform-tools", executable("adb")))
+}
+
+// SDKManager returns the path of the sdkmanager executable.
+func (s SDK) SDKManager() string {
+	return s.tool("sdkmanager", s.cmdlineTool(script("sdkmanager")))
+}
+
+// AVDManager returns the path of the avdmanager executable.
+func (s SDK) AVDManager() string {
+	return s.tool("avdmanager", s.cmdlineTool(script("avdmanager")))
+}
+
+// tool returns the absolute path of the tool at rel in the SDK root if it
+// exists there. Otherwise, it returns name, so that the tool is looked up in
+// PATH.
+func (s SDK) tool(name, rel string) string {
+	if s.Root == "" || rel == "" {
+		return name
+	}
+
+	path := filepath.Join(s.Root, rel)
+	if _, err := os.Stat(path); err != nil {
+		return name
+	}
+
+	return path
+}
+
+// executable returns the file name of the executable name, e.g. "adb.exe" on
+// Windows.
+func executable(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".exe"
+	}
+
+	return name
+}
+
+// script returns the file name of the script name, e.g. "sdkmanager.bat" on
+// Windows.
+func script(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".bat"
+	}
+
+	return name
+}
+
+// cmdlineTool returns the path of the command-line tool name relative to the
+// SDK root, preferring the latest version of cmdline-tools. It returns an
+// empty string if the tool isn't installed.
+func (s SDK) cmdlineTool(name string) string {
+	candidates := []string{filepath.Join("cmdline-tools", "latest", "bin", name)}
+
+	// Versioned installs, e.g. cmdline-tools/13.0/bin, newest first.
+	matches, _ := filepath.Glob(filepath.Join(s.Root, "cmdline-tools", "*", "bin", name))
+	version := func(match string) string { return filepath.Base(filepath.Dir(filepath.Dir(match))) }
+	slices.SortFunc(matches, func(a, b string) int { return compareVersions(version(b), version(a)) })
+	for _, match := range matches {
+		rel, err := filepath.Rel(s.Root, match)
+		if err == nil {
+			candidates = append(candidates, rel)
+		}
+	}
+
+	// Deprecated SDK Tools.
+	candidates = append(candidates, filepath.Join("tools", "bin", name))
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(filepath.Join(s.Root, candidate)); err == nil {
+			return candidate
+		}
+	}
+
+	return ""
+}
+
+// compareVersions compares dot-separated versions like "9.0" and "13.0"
+// numerically. Parts that aren't numbers are compared lexically.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		if aErr != nil || bErr != nil {
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		if an != bn {
+			return an - bn
+		}
+	}
+
+	return len(as) - len(bs)
+}
+
+// root returns the SDK root, or an error if it couldn't be found.
+func (s SDK) root() (string, error) {
+	if s.Root == "" {
+		return "", fmt.Errorf("%w: android sdk not found, set ANDROID_HOME", ErrToolMissing)
+	}
+
+	return s.Root, nil
+}
+
+// avdHome returns the AVD home, or an error if it couldn't be determined.
+func (s SDK) avdHome() (string, error) {
+	if s.AVDHome == "" {
+		return "", fmt.Errorf("can't determine where AVDs are stored, set ANDROID_AVD_HOME or ANDROID_USER_HOME")
+	}
+
+	return s.AVDHome, nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,49 @@
+package emulator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocateSDK(t *testing.T) {
+	root := t.TempDir()
+	userHome := t.TempDir()
+	t.Setenv("ANDROID_HOME", root)
+	t.Setenv("ANDROID_USER_HOME", userHome)
+	t.Setenv("ANDROID_AVD_HOME", "")
+
+	adb, sdkmanager := executable("adb"), script("sdkmanager")
+	for _, rel := range []string{"platform-tools/" + adb, "cmdline-tools/9.0/bin/" + sdkmanager, "cmdline-tools/12.0/bin/" + sdkmanager, "cmdline-tools/13.0/bin/" + sdkmanager} {
+		path := filepath.Join(root, rel)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, nil, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sdk := LocateSDK()
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "Root", got: sdk.Root, want: root},
+		{name: "UserHome", got: sdk.UserHome, want: userHome},
+		{name: "AVDHome", got: sdk.AVDHome, want: filepath.Join(userHome, "avd")},
+		{name: "ADB", got: sdk.ADB(), want: filepath.Join(root, "platform-tools", adb)},
+		{name: "SDKManager", got: sdk.SDKManager(), want: filepath.Join(root, "cmdline-tools", "13.0", "bin", sdkmanager)},
+		{name: "Emulator", got: sdk.Emulator(), want: "emulator"},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package emulator
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
+	"runtime"
+	"slices"
 	"strings"
 )
 
@@ -29,15 +31,43 @@ func (s SystemImage) ApiLevel() string {
 	return substrings[1]
 }
 
+// Tag returns the tag of this system image, e.g. "google_apis_playstore".
+func (s SystemImage) Tag() string {
+	substrings := strings.Split(string(s), ";")
+	if len(substrings) != 4 {
+		return ""
+	}
+
+	return substrings[2]
+}
+
+// ABI returns the ABI of this system image, e.g. "x86_64" or "arm64-v8a".
+func (s SystemImage) ABI() string {
+	str := string(s)
+	return str[strings.LastIndex(str, ";")+1:]
+}
+
+// HostABI returns the ABI of system images that run natively on this machine.
+func HostABI() string {
+	if runtime.GOARCH == "arm64" {
+		return "arm64-v8a"
+	}
+
+	return "x86_64"
+}
+
 // SystemImages returns installed Android system images.
 func SystemImages() ([]SystemImage, error) {
+	return SystemImagesContext(context.Background())
+}
+
+// SystemImagesContext is like SystemImages but uses ctx to run sdkmanager.
+func SystemImagesContext(ctx context.Context) ([]SystemImage, error) {
 	systemImages := make([]SystemImage, 0)
 
-	cmd := exec.Command("sdkmanager", "--list_installed")
-	printInvocation(cmd)
-	output, err := cmd.Output()
+	output, err := CommandRunner.Run(ctx, LocateSDK().SDKManager(), "--list_installed")
 	if err != nil {
-		return nil, fmt.Errorf("failed to run sdkmanager: %v", err)
+		return nil, fmt.Errorf("failed to run sdkmanager: %w", err)
 	}
 
 	// Sample output:
@@ -55,3 +85,75 @@ func SystemImages() ([]SystemImage, error) {
 
 	return systemImages, nil
 }
+
+// tagPreference orders tags of system images from the most to the least
+// preferred, when no tag is requested.
+var tagPreference = []string{"google_apis_playstore", "google_apis", "default"}
+
+// SelectSystemImage returns the best of images for API level api and, if not
+// empty, tag and abi. Images for HostABI are preferred, then images with tags
+// in the order of google_apis_playstore, google_apis, and default.
+//
+// It fails if none of images matches api, tag, and abi.
+func SelectSystemImage(images []SystemImage, api, tag, abi string) (SystemImage, error) {
+	var matching []SystemImage
+	for _, image := range images {
+		if strings.Count(string(image), ";") != 3 || image.ApiLevel() != api {
+			continue
+		}
+		if tag != "" && image.Tag() != tag {
+			continue
+		}
+		if abi != "" && image.ABI() != abi {
+			continue
+		}
+
+		matching = append(matching, image)
+	}
+
+	if len(matching) == 0 {
+		msg := "no system image for API level " + api
+		if tag != "" {
+			msg += " with tag " + tag
+		}
+		if abi != "" {
+			msg += " for ABI " + abi
+		}
+		return "", fmt.Errorf("%s is installed", msg)
+	}
+
+	rank := func(image SystemImage) int {
+		r := len(tagPreference)
+		if i := slices.Index(tagPreference, image.Tag()); i != -1 {
+			r = i
+		}
+		if image.ABI() != HostABI() {
+			r += len(tagPreference) + 1
+		}
+		return r
+	}
+
+	return slices.MinFunc(matching, func(a, b SystemImage) int { return rank(a) - rank(b) }), nil
+}
+
+// InstallSystemImage installs image with sdkmanager.
+//
+// Licenses of the image must have been accepted with 'sdkmanager --licenses'.
+func InstallSystemImage(ctx context.Context, image SystemImage) error {
+	_, err := CommandRunner.Run(ctx, LocateSDK().SDKManager(), "--install", string(image))
+	if err != nil {
+		return fmt.Errorf("failed to run sdkmanager: %w", err)
+	}
+
+	// sdkmanager skips packages whose licenses weren't accepted, but exits
+	// successfully.
+	images, err := SystemImagesContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(images, image) {
+		return fmt.Errorf("%s wasn't installed, accept its license with 'sdkmanager --licenses' and try again", image)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package emulator
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestSystemImages(t *testing.T) {
+	useFakeRunner(t, map[string]string{
+		"sdkmanager --list_installed": `Installed packages:
+  Path                                                     | Version       | Description                                 | Location
+  -------                                                  | -------       | -------                                     | -------
+  build-tools;35.0.0                                       | 35.0.0        | Android SDK Build-Tools 35                  | build-tools/35.0.0
+  system-images;android-33;google_apis;arm64-v8a           | 17            | Google APIs ARM 64 v8a System Image         | system-images/android-33/google_apis/arm64-v8a
+  system-images;android-34;google_apis_playstore;arm64-v8a | 9             | Google Play ARM 64 v8a System Image         | system-images/android-34/google_apis_playstore/arm64-v8a
+`,
+	})
+
+	images, err := SystemImages()
+	if err != nil {
+		t.Fatalf("SystemImages() error: %v", err)
+	}
+
+	want := []SystemImage{
+		"system-images;android-33;google_apis;arm64-v8a",
+		"system-images;android-34;google_apis_playstore;arm64-v8a",
+	}
+	if !slices.Equal(images, want) {
+		t.Errorf("SystemImages() = %v, want %v", images, want)
+	}
+}
+
+func TestSelectSystemImage(t *testing.T) {
+	other := "x86_64"
+	if HostABI() == "x86_64" {
+		other = "arm64-v8a"
+	}
+
+	images := []SystemImage{
+		SystemImage("system-images;android-34;google_apis;" + HostABI()),
+		SystemImage("system-images;android-35;google_apis_playstore;" + other),
+		SystemImage("system-images;android-35;default;" + HostABI()),
+		SystemImage("system-images;android-35;google_apis;" + HostABI()),
+		SystemImage("system-images;android-36;google_apis;" + other),
+	}
+
+	tests := []struct {
+		api     string
+		tag     string
+		abi     string
+		want    SystemImage
+		wantErr bool
+	}{
+		{api: "35", want: SystemImage("system-images;android-35;google_apis;" + HostABI())},
+		{api: "35", tag: "default", want: SystemImage("system-images;android-35;default;" + HostABI())},
+		{api: "35", tag: "google_apis_playstore", want: SystemImage("system-images;android-35;google_apis_playstore;" + other)},
+		{api: "36", want: SystemImage("system-images;android-36;google_apis;" + other)},
+		{api: "35", abi: other, want: SystemImage("system-images;android-35;google_apis_playstore;" + other)},
+		{api: "35", tag: "google_apis", abi: other, wantErr: true},
+		{api: "36", abi: HostABI(), wantErr: true},
+		{api: "34", tag: "google_apis_playstore", wantErr: true},
+		{api: "33", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		image, err := SelectSystemImage(images, tt.api, tt.tag, tt.abi)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("SelectSystemImage(%q, %q, %q) = %s, want error", tt.api, tt.tag, tt.abi, image)
+			}
+			continue
+		}
+
+		if err != nil || image != tt.want {
+			t.Errorf("SelectSystemImage(%q, %q, %q) = %s, %v, want %s", tt.api, tt.tag, tt.abi, image, err, tt.want)
+		}
+	}
+}
+
+func TestInstallSystemImage(t *testing.T) {
+	runner := useFakeRunner(t, map[string]string{
+		"sdkmanager --list_installed": "  system-images;android-35;google_apis;x86_64 | 9 | Google APIs Intel x86_64 Atom System Image | system-images/android-35/google_apis/x86_64\n",
+	})
+
+	err := InstallSystemImage(context.Background(), "system-images;android-35;google_apis;x86_64")
+	if err != nil {
+		t.Errorf("InstallSystemImage() error: %v", err)
+	}
+	if calls := runner.Calls(); calls[0] != "sdkmanager --install system-images;android-35;google_apis;x86_64" {
+		t.Errorf("first invocation = %q, want sdkmanager --install", calls[0])
+	}
+
+	// The license of this image wasn't accepted, so sdkmanager skipped it.
+	err = InstallSystemImage(context.Background(), "system-images;android-36;google_apis;x86_64")
+	if err == nil {
+		t.Errorf("InstallSystemImage() of skipped image: error = nil, want error")
+	}
+}
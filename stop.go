@@ -0,0 +1,194 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/bartekpacia/emu/console"
+)
+
+// lockTimeout is how long to wait for lock files of an AVD to be removed
+// after its emulator exited.
+var lockTimeout = 10 * time.Second
+
+// shutdownRequestTimeout is how long asking an emulator to shut down may
+// take. A hung emulator may accept console connections, but never reply.
+var shutdownRequestTimeout = 5 * time.Second
+
+// exitPollInterval is how often a stopping emulator is checked for having
+// exited.
+var exitPollInterval = 100 * time.Millisecond
+
+// StopOptions configures how an emulator is stopped.
+type StopOptions struct {
+	// Force kills the emulator with SIGKILL right away, without asking it to
+	// shut down. Its quickboot snapshot isn't saved and its user data may be
+	// corrupted.
+	Force bool
+
+	// GracePeriod is how long to wait for the emulator to shut down after
+	// asking it to through its console or adb. 20 seconds if 0.
+	GracePeriod time.Duration
+
+	// TermTimeout is how long to wait for the emulator to exit after sending
+	// it SIGTERM, before killing it with SIGKILL. 10 seconds if 0.
+	TermTimeout time.Duration
+}
+
+// Stop stops the emulator instance.
+//
+// It asks the emulator to shut down through its console, or with
+// 'adb emu kill' if the console isn't reachable, so that it saves its
+// quickboot snapshot. If the emulator doesn't exit within opts.GracePeriod, it
+// is sent SIGTERM, and if it still doesn't exit within opts.TermTimeout,
+// SIGKILL.
+func (i Instance) Stop(ctx context.Context, opts StopOptions) error {
+	if opts.GracePeriod == 0 {
+		opts.GracePeriod = 20 * time.Second
+	}
+	if opts.TermTimeout == 0 {
+		opts.TermTimeout = 10 * time.Second
+	}
+
+	proc, err := os.FindProcess(i.Pid)
+	if err != nil {
+		return fmt.Errorf("find process %d: %w", i.Pid, err)
+	}
+
+	if !opts.Force {
+		if i.requestShutdown(ctx) {
+			exited, err := waitForExit(ctx, proc, opts.GracePeriod)
+			if exited || err != nil {
+				return err
+			}
+		}
+
+		err = proc.Signal(syscall.SIGTERM)
+		if errors.Is(err, os.ErrProcessDone) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("send SIGTERM to process %d: %w", i.Pid, err)
+		}
+
+		exited, err := waitForExit(ctx, proc, opts.TermTimeout)
+		if exited || err != nil {
+			return err
+		}
+	}
+
+	err = proc.Kill()
+	if errors.Is(err, os.ErrProcessDone) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("kill process %d: %w", i.Pid, err)
+	}
+
+	exited, err := waitForExit(ctx, proc, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if !exited {
+		return fmt.Errorf("process %d didn't exit after SIGKILL", i.Pid)
+	}
+
+	return nil
+}
+
+// requestShutdown asks the emulator to shut down through its console, or
+// with adb if the console isn't reachable. It reports whether the request was
+// sent. Each attempt is given up on after shutdownRequestTimeout.
+func (i Instance) requestShutdown(ctx context.Context) bool {
+	if i.Port != 0 && i.requestConsoleShutdown(ctx) {
+		return true
+	}
+
+	if i.Serial != "" {
+		ctx, cancel := context.WithTimeout(ctx, shutdownRequestTimeout)
+		defer cancel()
+
+		_, err := NewDevice(i.Serial).adb(ctx, "emu", "kill")
+		return err == nil
+	}
+
+	return false
+}
+
+func (i Instance) requestConsoleShutdown(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, shutdownRequestTimeout)
+	defer cancel()
+
+	conn, err := console.Dial(ctx, i.Port)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	// The emulator may close the connection before replying, but if it
+	// refused the command, it won't shut down.
+	_, err = conn.Command(ctx, "kill")
+	var consoleErr *console.Error
+	if errors.As(err, &consoleErr) {
+		return false
+	}
+
+	return ctx.Err() == nil
+}
+
+// waitForExit waits up to timeout for proc to exit and reports whether it
+// did.
+func waitForExit(ctx context.Context, proc *os.Process, timeout time.Duration) (bool, error) {
+	ticker := time.NewTicker(exitPollInterval)
+	defer ticker.Stop()
+
+	deadline := time.After(timeout)
+	for {
+		if !processRunning(proc) {
+			return true, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-deadline:
+			return false, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForLocks waits up to timeout until the AVD at path has no lock files,
+// which the emulator removes after it exits. Lock files left behind by an
+// emulator that was killed are ignored after timeout, because the emulator
+// detects them as stale.
+func waitForLocks(ctx context.Context, path string, timeout time.Duration) error {
+	ticker := time.NewTicker(exitPollInterval)
+	defer ticker.Stop()
+
+	deadline := time.After(timeout)
+	for {
+		locks, err := filepath.Glob(filepath.Join(path, "*.lock"))
+		if err != nil || len(locks) == 0 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// processRunning reports whether proc hasn't exited yet.
+func processRunning(proc *os.Process) bool {
+	return proc.Signal(syscall.Signal(0)) == nil
+}
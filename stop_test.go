@@ -0,0 +1,207 @@
+package emulator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startProcess starts a shell running script, which stands in for an
+// emulator, and returns its PID. The process is reaped when it exits.
+func startProcess(t *testing.T, script string) int {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("uses unix signals")
+	}
+
+	cmd := exec.Command("sh", "-c", script)
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go cmd.Wait()
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	return cmd.Process.Pid
+}
+
+func TestStop(t *testing.T) {
+	runner := useFakeRunner(t, nil)
+	pid := startProcess(t, "exec sleep 60")
+
+	instance := Instance{Pid: pid, Serial: "emulator-5554"}
+	err := instance.Stop(context.Background(), StopOptions{GracePeriod: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+
+	// sleep ignores 'adb emu kill', so it must have been stopped by SIGTERM.
+	want := []string{"adb -s emulator-5554 emu kill"}
+	if calls := runner.Calls(); !slices.Equal(calls, want) {
+		t.Errorf("invocations = %q, want %q", calls, want)
+	}
+}
+
+func TestStopEscalates(t *testing.T) {
+	useFakeRunner(t, nil)
+	pid := startProcess(t, "trap '' TERM; exec sleep 60")
+
+	instance := Instance{Pid: pid}
+	err := instance.Stop(context.Background(), StopOptions{TermTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+}
+
+// fakeConsole accepts console connections and handles them with handle.
+// It returns the console port.
+func fakeConsole(t *testing.T, handle func(conn net.Conn)) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestStopHungConsole(t *testing.T) {
+	useFakeRunner(t, nil)
+	pid := startProcess(t, "exec sleep 60")
+
+	timeout := shutdownRequestTimeout
+	shutdownRequestTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { shutdownRequestTimeout = timeout })
+
+	// The console accepts connections, but never sends its banner.
+	port := fakeConsole(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+
+	instance := Instance{Pid: pid, Port: port}
+	start := time.Now()
+	err := instance.Stop(context.Background(), StopOptions{GracePeriod: time.Minute})
+	if err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+
+	// The request wasn't sent, so the emulator must have been sent SIGTERM
+	// without waiting for the grace period.
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Stop() took %v", elapsed)
+	}
+}
+
+func TestStopConsoleRefuses(t *testing.T) {
+	useFakeRunner(t, nil)
+	pid := startProcess(t, "exec sleep 60")
+
+	port := fakeConsole(t, func(conn net.Conn) {
+		fmt.Fprint(conn, "Android Console: type 'help' for a list of commands\r\nOK\r\n")
+		bufio.NewReader(conn).ReadString('\n')
+		fmt.Fprint(conn, "KO: unknown command, try 'help'\r\n")
+		io.Copy(io.Discard, conn)
+	})
+
+	instance := Instance{Pid: pid, Port: port}
+	start := time.Now()
+	err := instance.Stop(context.Background(), StopOptions{GracePeriod: time.Minute})
+	if err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+
+	// The emulator refused to shut down, so it must have been sent SIGTERM
+	// without waiting for the grace period.
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Stop() took %v", elapsed)
+	}
+}
+
+func TestStopForce(t *testing.T) {
+	runner := useFakeRunner(t, nil)
+	pid := startProcess(t, "trap '' TERM; exec sleep 60")
+
+	instance := Instance{Pid: pid, Serial: "emulator-5554"}
+	start := time.Now()
+	err := instance.Stop(context.Background(), StopOptions{Force: true})
+	if err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Stop() with Force took %v", elapsed)
+	}
+	if calls := runner.Calls(); len(calls) != 0 {
+		t.Errorf("invocations = %q, want none", calls)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	runner := useFakeRunner(t, nil)
+	pid := startProcess(t, "exec sleep 60")
+
+	avd := AVD{Name: "Pixel_7_API_34", Path: t.TempDir(), Running: true}
+	instance := Instance{Pid: pid, Args: []string{"@Pixel_7_API_34", "-no-window", "-wipe-data"}}
+	avd.Instances = []Instance{instance}
+
+	_, err := avd.Restart(context.Background(), instance, RestartOptions{ColdBoot: true})
+	if err != nil {
+		t.Fatalf("Restart() error: %v", err)
+	}
+
+	calls := runner.Calls()
+	want := "emulator @Pixel_7_API_34 -no-window -no-snapshot-load"
+	if calls[len(calls)-1] != want {
+		t.Errorf("last invocation = %q, want %q", calls[len(calls)-1], want)
+	}
+}
+
+func TestRestartKeepsPort(t *testing.T) {
+	useAVDHome(t, "Pixel_7_API_34")
+	useProcRoot(t, filepath.Join(t.TempDir(), "missing"))
+	runner := useFakeRunner(t, nil)
+	pid := startProcess(t, "exec sleep 60")
+
+	avd := AVD{Name: "Pixel_7_API_34", Path: t.TempDir(), Running: true}
+	instance := Instance{Pid: pid, Port: 5556, Args: []string{"@Pixel_7_API_34", "-no-window"}}
+	avd.Instances = []Instance{instance}
+
+	emu, err := avd.Restart(context.Background(), instance, RestartOptions{Stop: StopOptions{Force: true}})
+	if err != nil {
+		t.Fatalf("Restart() error: %v", err)
+	}
+
+	calls := runner.Calls()
+	want := "emulator @Pixel_7_API_34 -no-window -port 5556"
+	if calls[len(calls)-1] != want {
+		t.Errorf("last invocation = %q, want %q", calls[len(calls)-1], want)
+	}
+	if emu.Port != 5556 {
+		t.Errorf("Port = %d, want 5556", emu.Port)
+	}
+}